@@ -0,0 +1,148 @@
+package errplane
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// aggregatedSeries accumulates the values of one metric, context and set of
+// dimensions during a flush interval
+type aggregatedSeries struct {
+	metric     string
+	context    string
+	dimensions Dimensions
+	count      int
+	sum        float64
+	min        float64
+	max        float64
+}
+
+func (self *aggregatedSeries) add(value float64) {
+	if self.count == 0 || value < self.min {
+		self.min = value
+	}
+	if self.count == 0 || value > self.max {
+		self.max = value
+	}
+	self.count++
+	self.sum += value
+}
+
+func (self *aggregatedSeries) point(value float64) *JsonPoint {
+	return &JsonPoint{
+		Value:      value,
+		Context:    self.context,
+		Dimensions: self.dimensions,
+	}
+}
+
+// aggregator pre-aggregates Sum and Aggregate points in process, every
+// series is sent once per flush interval. Sums are sent as a single point
+// with the total, timings as the derived metrics <metric>.count, .min, .max,
+// .mean and .sum.
+type aggregator struct {
+	lock     sync.Mutex
+	counters map[string]*aggregatedSeries
+	timings  map[string]*aggregatedSeries
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{
+		counters: make(map[string]*aggregatedSeries),
+		timings:  make(map[string]*aggregatedSeries),
+	}
+}
+
+func seriesKey(metric, context string, dimensions Dimensions) string {
+	keys := make([]string, 0, len(dimensions))
+	for key := range dimensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, 2+2*len(keys))
+	parts = append(parts, metric, context)
+	for _, key := range keys {
+		parts = append(parts, key, dimensions[key])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Returns false if the operation type isn't aggregated
+func (self *aggregator) add(operation, metric string, point *JsonPoint) bool {
+	var series map[string]*aggregatedSeries
+	switch operation {
+	case "c":
+		series = self.counters
+	case "t":
+		series = self.timings
+	default:
+		return false
+	}
+
+	key := seriesKey(metric, point.Context, point.Dimensions)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	s := series[key]
+	if s == nil {
+		var dimensions Dimensions
+		if point.Dimensions != nil {
+			dimensions = make(Dimensions, len(point.Dimensions))
+			for key, value := range point.Dimensions {
+				dimensions[key] = value
+			}
+		}
+		s = &aggregatedSeries{metric: metric, context: point.Context, dimensions: dimensions}
+		series[key] = s
+	}
+	s.add(point.Value)
+	return true
+}
+
+// The number of points the next flush will return
+func (self *aggregator) pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.counters) + 5*len(self.timings)
+}
+
+// Return the aggregated points and start a new interval
+func (self *aggregator) flush() []*ErrplanePost {
+	self.lock.Lock()
+	counters, timings := self.counters, self.timings
+	self.counters = make(map[string]*aggregatedSeries)
+	self.timings = make(map[string]*aggregatedSeries)
+	self.lock.Unlock()
+
+	posts := make([]*ErrplanePost, 0, len(counters)+5*len(timings))
+	for _, series := range counters {
+		posts = append(posts, aggregatedPost("c", series.metric, series.point(series.sum)))
+	}
+	for _, series := range timings {
+		posts = append(posts,
+			aggregatedPost("r", series.metric+".count", series.point(float64(series.count))),
+			aggregatedPost("r", series.metric+".min", series.point(series.min)),
+			aggregatedPost("r", series.metric+".max", series.point(series.max)),
+			aggregatedPost("r", series.metric+".mean", series.point(series.sum/float64(series.count))),
+			aggregatedPost("r", series.metric+".sum", series.point(series.sum)),
+		)
+	}
+	return posts
+}
+
+func aggregatedPost(operation, metric string, point *JsonPoint) *ErrplanePost {
+	return &ErrplanePost{
+		postType: UDP,
+		operation: &WriteOperation{
+			Operation: operation,
+			Writes: []*JsonPoints{
+				&JsonPoints{
+					Name:   metric,
+					Points: []*JsonPoint{point},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package errplane
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+type AggregationSuite struct{}
+
+var _ = Suite(&AggregationSuite{})
+
+// index the points of the given operation type by metric name
+func pointsByName(operations []*WriteOperation, operation string) map[string][]*JsonPoint {
+	points := make(map[string][]*JsonPoint)
+	for _, op := range operations {
+		if op.Operation != operation {
+			continue
+		}
+		for _, write := range op.Writes {
+			points[write.Name] = append(points[write.Name], write.Points...)
+		}
+	}
+	return points
+}
+
+func (s *AggregationSuite) TestAggregatesSums(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(transport)
+	ep.EnablePreAggregation()
+
+	for i := 0; i < 10; i++ {
+		c.Assert(ep.Sum("requests", 2, "", Dimensions{"host": "a"}), IsNil)
+	}
+	c.Assert(ep.Sum("requests", 1, "", Dimensions{"host": "b"}), IsNil)
+	c.Assert(ep.Sum("requests", 1, "other_context", Dimensions{"host": "b"}), IsNil)
+	ep.Close()
+
+	sums := pointsByName(transport.sent(), "c")
+	c.Assert(sums["requests"], HasLen, 3)
+	totals := make(map[string]float64)
+	for _, point := range sums["requests"] {
+		totals[point.Context+"/"+point.Dimensions["host"]] = point.Value
+	}
+	c.Assert(totals, DeepEquals, map[string]float64{"/a": 20, "/b": 1, "other_context/b": 1})
+}
+
+func (s *AggregationSuite) TestAggregatesTimings(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(transport)
+	ep.EnablePreAggregation()
+
+	for _, value := range []float64{4, 1, 7} {
+		c.Assert(ep.Aggregate("latency", value, "some_context", Dimensions{"foo": "bar"}), IsNil)
+	}
+	c.Assert(ep.ReportUDP("gauge", 5, "", nil), IsNil)
+	ep.Close()
+
+	c.Assert(pointsByName(transport.sent(), "t"), HasLen, 0)
+	reports := pointsByName(transport.sent(), "r")
+	expected := map[string]float64{
+		"latency.count": 3,
+		"latency.min":   1,
+		"latency.max":   7,
+		"latency.mean":  4,
+		"latency.sum":   12,
+		"gauge":         5,
+	}
+	c.Assert(reports, HasLen, len(expected))
+	for name, value := range expected {
+		c.Assert(reports[name], HasLen, 1)
+		c.Assert(reports[name][0].Value, Equals, value)
+	}
+	c.Assert(reports["latency.mean"][0].Context, Equals, "some_context")
+	c.Assert(reports["latency.mean"][0].Dimensions, DeepEquals, map[string]string{"foo": "bar"})
+}
+
+func (s *AggregationSuite) TestSeriesKeyIgnoresDimensionOrder(c *C) {
+	a := seriesKey("metric", "", Dimensions{"a": "1", "b": "2"})
+	b := seriesKey("metric", "", Dimensions{"b": "2", "a": "1"})
+	c.Assert(a, Equals, b)
+	c.Assert(seriesKey("metric", "", Dimensions{"a": "1b"}), Not(Equals), seriesKey("metric", "", Dimensions{"a1": "b"}))
+}
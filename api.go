@@ -1,15 +1,19 @@
 package errplane
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,30 +45,121 @@ const (
 	HTTP
 )
 
-var METRIC_REGEX, _ = regexp.Compile("^[a-zA-Z0-9._]*$")
+func (self PostType) String() string {
+	if self == UDP {
+		return "udp"
+	}
+	return "http"
+}
+
+// OverflowPolicy decides what happens to new points when the queue of
+// points waiting to be sent is full.
+type OverflowPolicy int
+
+const (
+	// wait until there's room in the queue
+	OverflowBlock OverflowPolicy = iota
+	// drop the new point
+	OverflowDropNewest
+	// drop the oldest point in the queue to make room for the new one
+	OverflowDropOldest
+	// wait until there's room in the queue or the overflow timeout expires,
+	// in which case the new point is dropped
+	OverflowBlockTimeout
+)
+
+var (
+	ErrQueueFull = errors.New("Errplane queue is full, point dropped")
+	ErrClosed    = errors.New("Errplane client is closed")
+
+	ErrCardinalityLimit = errors.New("Too many distinct dimensions for metric, point dropped")
+)
+
+// The ascii names accepted by DEFAULT_NAME_POLICY, regardless of length.
+//
+// Deprecated: use ValidateMetricName or NamePolicy.Validate, which check the
+// length too and report where a name is invalid.
+var METRIC_REGEX, _ = regexp.Compile("^[a-zA-Z0-9._-]*$")
 
 type ErrplanePost struct {
 	postType  PostType
 	operation *WriteOperation
 }
 
+// Errplane is the client used to send points. Views created with WithPrefix
+// and WithDimensions are also *Errplane and share the client of their parent.
 type Errplane struct {
+	*client
+	prefix     string
+	dimensions Dimensions
+	// the client's own metrics aren't subject to NamePolicy.ReservedPrefixes
+	internal bool
+}
+
+// the state shared between an Errplane object and its views. transportLock
+// guards the transports and every setting that can be changed while points
+// are sent in the background.
+type client struct {
+	droppedPoints       uint64
+	pendingPoints       int64
+	stats               clientStats
 	proto               string
-	udpConn             *net.UDPConn
-	url                 string
+	urls                []string
+	httpPolicy          MultiPolicy
+	transportLock       sync.RWMutex
+	httpClient          *http.Client
+	ownsHttpClient      bool
+	retryPolicy         RetryPolicy
+	compressor          Compressor
+	compressionMin      int
+	spool               *spool
+	proxyUrl            *url.URL
+	tlsConfig           *tls.Config
+	streamTlsConfig     *tls.Config
+	tcpAddr             string
+	tcpTlsConfig        *tls.Config
+	tcpTransport        *StreamTransport
+	httpTransport       Transport
+	udpTransport        Transport
+	breakers            map[PostType]*circuitBreaker
+	rateLimiters        map[PostType]*rateLimiter
+	cardinality         *cardinalityLimiter
+	dimensionRules      *DimensionRules
+	namePolicy          NamePolicy
 	apiKey              string
 	database            string
 	Timeout             time.Duration
-	closeChan           chan bool
+	closing             chan struct{}
+	done                chan struct{}
+	closeErr            error
+	flushRequests       chan chan error
+	closeOnce           sync.Once
+	abandoned           chan struct{}
+	abandonOnce         sync.Once
+	closeLock           sync.RWMutex
 	msgChan             chan *ErrplanePost
-	closed              bool
 	timeout             time.Duration
-	runtimeStatsRunning bool
+	runtimeStatsRunning int32
+	clientStatsRunning  int32
+	overflowPolicy      OverflowPolicy
+	overflowTimeout     time.Duration
+	aggregator          *aggregator
+	histograms          *histograms
+	flushInterval       time.Duration
+	batchSize           int
+	errorHandler        ErrorHandler
+	logger              Logger
+	maxDatagramSize     int
+	clock               Clock
 }
 
 const (
-	DEFAULT_HTTP_HOST = "w.apiv3.errplane.com"
-	DEFAULT_UDP_ADDR  = "udp.apiv3.errplane.com:8126"
+	DEFAULT_HTTP_HOST  = "w.apiv3.errplane.com"
+	DEFAULT_UDP_ADDR   = "udp.apiv3.errplane.com:8126"
+	DEFAULT_QUEUE_SIZE = 10000
+
+	// the time Close waits for buffered points to be sent
+	DEFAULT_CLOSE_TIMEOUT = 30 * time.Second
 )
 
 // Initializer.
@@ -80,41 +175,121 @@ func newTestClient(app, environment, apiKey string) *Errplane {
 }
 
 func newCommon(proto, app, environment, apiKey string) *Errplane {
-	database := fmt.Sprintf("%s%s", app, environment)
-	ep := &Errplane{
-		proto:     proto,
-		database:  database,
-		apiKey:    apiKey,
-		Timeout:   1 * time.Second,
-		msgChan:   make(chan *ErrplanePost),
-		closeChan: make(chan bool),
-		closed:    false,
-		timeout:   2 * time.Second,
-	}
-	ep.SetHttpHost(DEFAULT_HTTP_HOST)
-	ep.SetUdpAddr(DEFAULT_UDP_ADDR)
-	ep.setTransporter(nil)
-	go ep.processMessages()
+	// the default configuration is always valid
+	ep, _ := newClient(defaultConfig(proto, app, environment, apiKey))
 	return ep
 }
 
-// call from a goroutine, this method never returns
+func newClient(config *config) (*Errplane, error) {
+	database := fmt.Sprintf("%s%s", config.app, config.environment)
+	ep := &Errplane{client: &client{
+		proto:    config.proto,
+		database: database,
+		apiKey:   config.apiKey,
+		Timeout:  1 * time.Second,
+		msgChan:  make(chan *ErrplanePost, config.queueSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+		timeout:  config.timeout,
+
+		flushRequests:   make(chan chan error),
+		abandoned:       make(chan struct{}),
+		proxyUrl:        config.proxy,
+		tlsConfig:       config.tlsConfig,
+		streamTlsConfig: config.streamTlsConfig,
+		retryPolicy:     config.retryPolicy,
+		compressor:      config.compressor,
+		compressionMin:  config.compressionThreshold,
+		histograms:      newHistograms(),
+		overflowPolicy:  config.overflowPolicy,
+		overflowTimeout: config.overflowTimeout,
+		flushInterval:   config.flushInterval,
+		batchSize:       config.batchSize,
+		errorHandler:    config.errorHandler,
+		logger:          config.logger,
+		maxDatagramSize: config.maxDatagramSize,
+		clock:           config.clock,
+		namePolicy:      config.namePolicy,
+		breakers: map[PostType]*circuitBreaker{
+			UDP:  newCircuitBreaker(config.breakerPolicy, config.clock),
+			HTTP: newCircuitBreaker(config.breakerPolicy, config.clock),
+		},
+		rateLimiters: map[PostType]*rateLimiter{
+			UDP:  newRateLimiter(config.rateLimits[UDP], config.clock),
+			HTTP: newRateLimiter(config.rateLimits[HTTP], config.clock),
+		},
+	}}
+	if err := ep.histograms.setPercentiles(config.percentiles); err != nil {
+		return nil, err
+	}
+
+	if config.httpClient != nil {
+		ep.SetHttpClient(config.httpClient)
+	} else {
+		ep.setTransporter()
+	}
+	if err := ep.SetHttpHosts(config.httpPolicy, config.httpHosts...); err != nil {
+		return nil, err
+	}
+	if config.httpTransport != nil {
+		ep.SetHttpTransport(config.httpTransport)
+	}
+	if config.udpTransport != nil {
+		ep.SetUdpTransport(config.udpTransport)
+	} else if config.tcpAddr != "" {
+		if err := ep.SetTcpAddr(config.tcpAddr, config.tcpTlsConfig); err != nil {
+			return nil, err
+		}
+	} else if err := ep.SetUdpAddrs(config.udpPolicy, config.udpAddrs...); err != nil {
+		return nil, err
+	}
+
+	if config.preAggregation {
+		ep.EnablePreAggregation()
+	}
+	if config.cardinalityLimit != nil {
+		ep.cardinality = newCardinalityLimiter(*config.cardinalityLimit, config.clock)
+	}
+	if config.dimensionRules != nil {
+		ep.dimensionRules = config.dimensionRules
+	}
+	if config.spool != nil {
+		if err := ep.EnableSpool(*config.spool); err != nil {
+			return nil, err
+		}
+	}
+
+	go ep.processMessages()
+	return ep, nil
+}
+
+// call from a goroutine, this method returns once the client is closed
 func (self *Errplane) processMessages() {
+	ticker := time.NewTicker(self.flushInterval)
+	defer ticker.Stop()
+	defer close(self.done)
+
 	posts := make([]*ErrplanePost, 0)
 	for {
 
 		select {
 		case x := <-self.msgChan:
 			posts = append(posts, x)
-			if len(posts) < 100 {
+			if len(posts) < self.batchSize {
 				continue
 			}
-			self.flushPosts(posts)
-		case <-time.After(1 * time.Second):
-			self.flushPosts(posts)
-		case <-self.closeChan:
-			self.flushPosts(posts)
-			self.closeChan <- true
+			self.flushQueued(posts, false)
+		case <-ticker.C:
+			self.flushQueued(posts, true)
+		case reply := <-self.flushRequests:
+			reply <- self.flushQueued(self.drainQueue(posts), true)
+		case <-self.closing:
+			// wait for the points that passed the closed check in
+			// sendCommon, they're in the queue once the lock is ours
+			self.closeLock.Lock()
+			self.closeLock.Unlock()
+			self.closeErr = self.flushQueued(self.drainQueue(posts), true)
+			self.closeTransports()
 			return
 		}
 
@@ -122,9 +297,72 @@ func (self *Errplane) processMessages() {
 	}
 }
 
-func (self *Errplane) flushPosts(posts []*ErrplanePost) {
+// flush the posts taken from the queue, and optionally the aggregated points
+func (self *Errplane) flushQueued(posts []*ErrplanePost, aggregates bool) error {
+	count := countPoints(posts)
+	if aggregates {
+		posts = self.flushAggregates(posts)
+		// the aggregated points are pending until they're delivered
+		aggregated := countPoints(posts) - count
+		atomic.AddInt64(&self.pendingPoints, int64(aggregated))
+		atomic.AddUint64(&self.stats.enqueued, uint64(aggregated))
+		count += aggregated
+	}
 	if len(posts) == 0 {
-		return
+		return nil
+	}
+	start := time.Now()
+	err := self.flushPosts(posts)
+	atomic.StoreInt64(&self.stats.flushLatency, int64(time.Since(start)))
+	atomic.AddInt64(&self.pendingPoints, -int64(count))
+	return err
+}
+
+func countPoints(posts []*ErrplanePost) int {
+	count := 0
+	for _, post := range posts {
+		count += post.operation.pointCount()
+	}
+	return count
+}
+
+func (self *WriteOperation) pointCount() int {
+	count := 0
+	for _, points := range self.Writes {
+		count += len(points.Points)
+	}
+	return count
+}
+
+// append the points aggregated during the last interval
+func (self *Errplane) flushAggregates(posts []*ErrplanePost) []*ErrplanePost {
+	posts = append(posts, self.histograms.flush()...)
+	self.transportLock.RLock()
+	aggregator := self.aggregator
+	self.transportLock.RUnlock()
+	if aggregator == nil {
+		return posts
+	}
+	return append(posts, aggregator.flush()...)
+}
+
+// append all the posts that are waiting in the queue
+func (self *Errplane) drainQueue(posts []*ErrplanePost) []*ErrplanePost {
+	for {
+		select {
+		case x := <-self.msgChan:
+			posts = append(posts, x)
+		default:
+			return posts
+		}
+	}
+}
+
+// send the posts and return the errors of all the batches that couldn't
+// be delivered
+func (self *Errplane) flushPosts(posts []*ErrplanePost) error {
+	if len(posts) == 0 {
+		return nil
 	}
 
 	var (
@@ -132,6 +370,7 @@ func (self *Errplane) flushPosts(posts []*ErrplanePost) {
 		udpReportPoints    = make([]*WriteOperation, 0)
 		udpSumPoints       = make([]*WriteOperation, 0)
 		udpAggregatePoints = make([]*WriteOperation, 0)
+		errs               = make(SendErrors, 0)
 	)
 
 	for _, post := range posts {
@@ -145,7 +384,14 @@ func (self *Errplane) flushPosts(posts []*ErrplanePost) {
 			case "c":
 				udpSumPoints = append(udpSumPoints, operation)
 			default:
-				panic(fmt.Errorf("Unknown point type %s", operation.Operation))
+				err := &DeliveryError{
+					Transport: post.postType.String(),
+					BatchSize: operation.pointCount(),
+					Err:       fmt.Errorf("Unknown point type %s", operation.Operation),
+				}
+				self.stats.addFailed(post.postType, err.BatchSize)
+				self.handleError(err)
+				errs = append(errs, err)
 			}
 		} else {
 			httpPoints = append(httpPoints, operation)
@@ -155,73 +401,263 @@ func (self *Errplane) flushPosts(posts []*ErrplanePost) {
 	// do the http ones first
 	httpPoint := self.mergeMetrics(httpPoints)
 	if httpPoint != nil {
-		if err := self.SendHttp(httpPoint); err != nil {
-			fmt.Fprintf(os.Stderr, "Error while posting points to Errplane. Error: %s\n", err)
-		}
+		errs = errs.append(self.deliver(HTTP, httpPoint))
 	}
 
 	// do the udp points here
 	udpReportPoint := self.mergeMetrics(udpReportPoints)
 	if udpReportPoint != nil {
 		udpReportPoint.Operation = "r"
-		if err := self.SendUdp(udpReportPoint); err != nil {
-			fmt.Fprintf(os.Stderr, "Error while posting points to Errplane. Error: %s\n", err)
-		}
+		errs = errs.append(self.deliver(UDP, udpReportPoint))
 	}
 	udpAggregatePoint := self.mergeMetrics(udpAggregatePoints)
 	if udpAggregatePoint != nil {
 		udpAggregatePoint.Operation = "t"
-		if err := self.SendUdp(udpAggregatePoint); err != nil {
-			fmt.Fprintf(os.Stderr, "Error while posting points to Errplane. Error: %s\n", err)
-		}
+		errs = errs.append(self.deliver(UDP, udpAggregatePoint))
 	}
 	udpSumPoint := self.mergeMetrics(udpSumPoints)
 	if udpSumPoint != nil {
 		udpSumPoint.Operation = "c"
-		if err := self.SendUdp(udpSumPoint); err != nil {
-			fmt.Fprintf(os.Stderr, "Error while posting points to Errplane. Error: %s\n", err)
+		errs = errs.append(self.deliver(UDP, udpSumPoint))
+	}
+	return errs.err()
+}
+
+// send the operation, if that fails with a retryable error and the spool is
+// enabled the operation is spooled to be replayed later. Returns a
+// *DeliveryError even if the operation was spooled.
+func (self *Errplane) deliver(postType PostType, operation *WriteOperation) error {
+	if operation = self.rateLimit(postType, operation); operation == nil {
+		return nil
+	}
+	err := self.send(postType, operation)
+	if err == nil {
+		atomic.AddUint64(&self.stats.flushed, uint64(operation.pointCount()))
+		return nil
+	}
+
+	deliveryErr := &DeliveryError{
+		Transport: postType.String(),
+		BatchSize: operation.pointCount(),
+		Retryable: isRetryable(err),
+		Err:       err,
+	}
+	var tooLarge *DatagramTooLargeError
+	var partial *PartialSendError
+	if errors.As(err, &tooLarge) {
+		// the points that fit in a datagram were sent
+		deliveryErr.BatchSize = tooLarge.Points
+		atomic.AddUint64(&self.stats.flushed, uint64(operation.pointCount()-tooLarge.Points))
+	} else if errors.As(err, &partial) {
+		// only the points that weren't sent are spooled
+		deliveryErr.BatchSize = partial.Remaining.pointCount()
+		atomic.AddUint64(&self.stats.flushed, uint64(operation.pointCount()-deliveryErr.BatchSize))
+		operation = partial.Remaining
+	}
+	self.transportLock.RLock()
+	spool := self.spool
+	self.transportLock.RUnlock()
+	if spool != nil && deliveryErr.Retryable {
+		if spoolErr := spool.append(postType, operation); spoolErr != nil {
+			self.handleError(fmt.Errorf("Error while spooling %d points. Error: %s", deliveryErr.BatchSize, spoolErr))
+		} else {
+			deliveryErr.Spooled = true
 		}
 	}
+	self.stats.addFailed(postType, deliveryErr.BatchSize)
+	self.handleError(deliveryErr)
+	return deliveryErr
+}
+
+// apply the rate limit of the transport, returns nil if every point was
+// dropped. Dropped points are counted in ClientStats.RateLimited. Once the
+// client is closing RateLimitQueue doesn't wait anymore, the final flush
+// sends the remaining batches right away instead of holding up Shutdown.
+func (self *Errplane) rateLimit(postType PostType, operation *WriteOperation) *WriteOperation {
+	self.transportLock.RLock()
+	limiter := self.rateLimiters[postType]
+	self.transportLock.RUnlock()
+
+	limited, wait := limiter.apply(operation)
+	if wait > 0 {
+		// don't hold up a shutdown
+		self.sleep(wait)
+	}
+	dropped := operation.pointCount()
+	if limited != nil {
+		dropped -= limited.pointCount()
+	}
+	atomic.AddUint64(&self.stats.rateLimited, uint64(dropped))
+	return limited
+}
+
+// Limit the points and bytes per second sent with the http or udp
+// transport, see RateLimit. A zero RateLimit removes the limit, which is
+// the default.
+func (self *Errplane) SetRateLimit(postType PostType, limit RateLimit) error {
+	if err := validateRateLimit(limit); err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.rateLimiters[postType] = newRateLimiter(limit, self.clock)
+	return nil
+}
+
+// pass the error to the error handler or log it if there's none
+func (self *Errplane) handleError(err error) {
+	self.transportLock.RLock()
+	handler, logger := self.errorHandler, self.logger
+	self.transportLock.RUnlock()
+	if handler != nil {
+		handler(err)
+		return
+	}
+	logger.Errorf("%s", err)
+}
+
+func (self *Errplane) warnf(format string, args ...interface{}) {
+	self.transportLock.RLock()
+	logger := self.logger
+	self.transportLock.RUnlock()
+	logger.Warnf(format, args...)
+}
+
+// Set the function called with errors that happen in the background, see
+// ErrorHandler
+func (self *Errplane) SetErrorHandler(handler ErrorHandler) {
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.errorHandler = handler
+}
+
+// Set the logger used for warnings and errors, see Logger. A nil logger
+// restores the default one, which prints to stderr.
+func (self *Errplane) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.logger = logger
+}
+
+// SendErrors holds the errors of all the batches that couldn't be sent
+type SendErrors []error
+
+func (self SendErrors) Error() string {
+	messages := make([]string, 0, len(self))
+	for _, err := range self {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (self SendErrors) append(err error) SendErrors {
+	if err == nil {
+		return self
+	}
+	if errs, ok := err.(SendErrors); ok {
+		return append(self, errs...)
+	}
+	return append(self, err)
+}
+
+// return nil instead of an empty SendErrors
+func (self SendErrors) err() error {
+	if len(self) == 0 {
+		return nil
+	}
+	return self
 }
 
 func (self *Errplane) Heartbeat(name string, interval time.Duration, context string, dimensions Dimensions) {
 	go func() {
 		for {
-			if self.closed {
+			if err := self.Report(name, 1.0, self.clock.Now(), context, dimensions); err == ErrClosed {
+				return
+			}
+			if !self.sleep(interval) {
 				return
 			}
-
-			self.Report(name, 1.0, time.Now(), context, dimensions)
-			time.Sleep(interval)
 		}
 	}()
 }
 
-func (self *Errplane) SendHttp(data *WriteOperation) error {
-	buf, err := json.Marshal(data.Writes)
-	if err != nil {
-		return fmt.Errorf("Cannot marshal %#v. Error: %s", data, err)
+// Sleep for the given duration, returns false if the client was closed in
+// the meantime
+func (self *Errplane) sleep(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-self.closing:
+		return false
 	}
+}
 
-	resp, err := http.Post(self.url, "application/json", bytes.NewReader(buf))
-	if err != nil {
+func (self *Errplane) isClosed() bool {
+	select {
+	case <-self.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *Errplane) send(postType PostType, data *WriteOperation) error {
+	transport := self.transport(postType)
+	if transport == nil {
+		return fmt.Errorf("No %s transport configured", postType)
+	}
+	breaker := self.breaker(postType)
+	if err := breaker.allow(); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 201 {
-		return fmt.Errorf("Server returned status code %d", resp.StatusCode)
+	err := transport.Send(data)
+	breaker.record(err)
+	return err
+}
+
+func (self *Errplane) breaker(postType PostType) *circuitBreaker {
+	self.transportLock.RLock()
+	defer self.transportLock.RUnlock()
+	return self.breakers[postType]
+}
+
+// Set the circuit breaker policy of the http and udp transports,
+// DEFAULT_BREAKER_POLICY by default. While a breaker is open batches fail
+// with ErrCircuitOpen right away and are spooled or counted as failed.
+func (self *Errplane) SetBreakerPolicy(policy BreakerPolicy) error {
+	if err := validateBreakerPolicy(policy); err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	for postType := range self.breakers {
+		self.breakers[postType] = newCircuitBreaker(policy, self.clock)
 	}
 	return nil
 }
 
-func (self *Errplane) SendUdp(data *WriteOperation) error {
-	buf, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("Cannot marshal %#v. Error: %s", data, err)
+func (self *Errplane) transport(postType PostType) Transport {
+	self.transportLock.RLock()
+	defer self.transportLock.RUnlock()
+	if postType == UDP {
+		return self.udpTransport
 	}
+	return self.httpTransport
+}
 
-	_, err = self.udpConn.Write(buf)
-	return err
+// Send the operation using the http transport
+func (self *Errplane) SendHttp(data *WriteOperation) error {
+	return self.send(HTTP, data)
+}
+
+// Send the operation using the udp transport
+func (self *Errplane) SendUdp(data *WriteOperation) error {
+	return self.send(UDP, data)
 }
 
 func (self *Errplane) mergeMetrics(operations []*WriteOperation) *WriteOperation {
@@ -254,39 +690,304 @@ func (self *Errplane) mergeMetrics(operations []*WriteOperation) *WriteOperation
 	}
 }
 
-// Close the errplane object and flush all buffered data points
+// Close the errplane object and flush all buffered data points, waiting at
+// most DEFAULT_CLOSE_TIMEOUT. Use Shutdown to choose the deadline and learn
+// about lost points. Calling Close more than once is safe.
 func (self *Errplane) Close() {
-	self.closed = true
-	// tell the go routine to finish
-	self.closeChan <- true
-	// wait for the go routine to finish
-	<-self.closeChan
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_CLOSE_TIMEOUT)
+	defer cancel()
+	self.Shutdown(ctx)
 }
 
+// Send all the points queued so far, including the pre-aggregated ones and
+// histograms, and wait until every batch was delivered or failed. Returns
+// SendErrors with the errors of the batches that couldn't be delivered (even
+// if they were spooled to be replayed later), ctx.Err() if ctx is done
+// first, or ErrClosed if the client is closed.
+func (self *Errplane) Flush(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case self.flushRequests <- reply:
+	case <-self.closing:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutdownError is returned by Shutdown if buffered points couldn't be sent
+// before the deadline.
+type ShutdownError struct {
+	// the number of points that were still waiting to be sent, including
+	// the pre-aggregated series and histograms, which count as the points
+	// they would have been flushed as
+	Lost int64
+	Err  error
+}
+
+func (self *ShutdownError) Error() string {
+	return fmt.Sprintf("Errplane shutdown didn't finish, %d points lost. Error: %s", self.Lost, self.Err)
+}
+
+// Close the errplane object and flush all buffered data points until ctx is
+// done. Once Shutdown is called Report, Sum, Aggregate, etc. return
+// ErrClosed. Calling Shutdown more than once is safe, every call waits for
+// the flush to finish. Returns the send errors of the final flush, see Flush.
+func (self *Errplane) Shutdown(ctx context.Context) error {
+	self.closeOnce.Do(func() { close(self.closing) })
+
+	select {
+	case <-self.done:
+		return self.closeErr
+	case <-ctx.Done():
+		// stop the retries of the final flush
+		self.abandonOnce.Do(func() { close(self.abandoned) })
+		return &ShutdownError{Lost: self.pending(), Err: ctx.Err()}
+	}
+}
+
+// the points that weren't delivered yet
+func (self *Errplane) pending() int64 {
+	pending := atomic.LoadInt64(&self.pendingPoints) + int64(self.histograms.pending())
+	self.transportLock.RLock()
+	aggregator := self.aggregator
+	self.transportLock.RUnlock()
+	if aggregator != nil {
+		pending += int64(aggregator.pending())
+	}
+	return pending
+}
+
+// Set the address udp points are sent to, either host:port, or
+// unix:///path and unixgram:///path to send them to a local agent over a
+// unix stream or datagram socket.
 func (self *Errplane) SetUdpAddr(addr string) error {
-	localAddr, err := net.ResolveUDPAddr("udp4", "")
-	if err != nil {
+	return self.SetUdpAddrs(MultiFailover, addr)
+}
+
+// Send udp points to several addresses, see SetUdpAddr for the accepted
+// formats. With MultiFailover points go to the first healthy address, with
+// MultiFanOut they go to all of them.
+func (self *Errplane) SetUdpAddrs(policy MultiPolicy, addrs ...string) error {
+	if err := validateMultiPolicy(policy, len(addrs)); err != nil {
 		return err
 	}
-	remoteAddr, err := net.ResolveUDPAddr("udp4", addr)
+	transports := make([]Transport, 0, len(addrs))
+	for _, addr := range addrs {
+		transport, err := self.newUdpTransport(addr)
+		if err != nil {
+			return err
+		}
+		transports = append(transports, transport)
+	}
+	transport, err := combineTransports(policy, transports)
 	if err != nil {
 		return err
 	}
-	udpConn, err := net.DialUDP("udp4", localAddr, remoteAddr)
+	self.SetUdpTransport(transport)
+	return nil
+}
+
+func (self *Errplane) newUdpTransport(addr string) (Transport, error) {
+	network, path, err := parseUdpAddr(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if self.udpConn != nil {
-		self.udpConn.Close()
+	self.transportLock.RLock()
+	timeout, maxDatagramSize := self.timeout, self.maxDatagramSize
+	self.transportLock.RUnlock()
+	if network == "unix" {
+		stream := NewUnixTransport(path)
+		stream.stats = &self.stats
+		stream.SetTimeout(timeout)
+		return stream, nil
 	}
-	self.udpConn = udpConn
-	return nil
+
+	transport, err := NewUdpTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+	transport.stats = &self.stats
+	transport.SetMaxDatagramSize(maxDatagramSize)
+	return transport, nil
+}
+
+// a single transport is used as is, several ones are wrapped in a
+// MultiTransport
+func combineTransports(policy MultiPolicy, transports []Transport) (Transport, error) {
+	if len(transports) == 1 {
+		return transports[0], nil
+	}
+	return NewMultiTransport(policy, transports...)
 }
 
 func (self *Errplane) SetHttpHost(host string) {
+	self.SetHttpHosts(MultiFailover, host)
+}
+
+// Send http points to several hosts. With MultiFailover points go to the
+// first healthy host, with MultiFanOut they go to all of them, e.g. to
+// write to an old and a new collector during a migration.
+func (self *Errplane) SetHttpHosts(policy MultiPolicy, hosts ...string) error {
+	if err := validateMultiPolicy(policy, len(hosts)); err != nil {
+		return err
+	}
 	params := url.Values{}
 	params.Set("api_key", self.apiKey)
-	self.url = fmt.Sprintf("%s://%s/databases/%s/points?%s", self.proto, host, self.database, params.Encode())
+	urls := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		urls = append(urls, fmt.Sprintf("%s://%s/databases/%s/points?%s", self.proto, host, self.database, params.Encode()))
+	}
+
+	self.transportLock.Lock()
+	self.urls = urls
+	self.httpPolicy = policy
+	self.transportLock.Unlock()
+	self.SetHttpTransport(self.newHttpTransport())
+	return nil
+}
+
+func (self *Errplane) newHttpTransport() Transport {
+	self.transportLock.RLock()
+	defer self.transportLock.RUnlock()
+	transports := make([]Transport, 0, len(self.urls))
+	for _, target := range self.urls {
+		transport := NewHttpTransport(target, self.httpClient)
+		transport.SetRetryPolicy(self.retryPolicy)
+		transport.SetCompression(self.compressor, self.compressionMin)
+		transport.stats = &self.stats
+		transport.stop = self.abandoned
+		transports = append(transports, transport)
+	}
+	transport, _ := combineTransports(self.httpPolicy, transports)
+	return transport
+}
+
+// install a new default http transport to pick up configuration changes,
+// custom transports are left alone
+func (self *Errplane) resetHttpTransport() {
+	self.transportLock.RLock()
+	isDefault := true
+	for _, transport := range transportTargets(self.httpTransport) {
+		if _, ok := transport.(*HttpTransport); !ok {
+			isDefault = false
+		}
+	}
+	self.transportLock.RUnlock()
+
+	if isDefault {
+		self.SetHttpTransport(self.newHttpTransport())
+	}
+}
+
+// the targets of a MultiTransport, or the transport itself
+func transportTargets(transport Transport) []Transport {
+	if multi, ok := transport.(*MultiTransport); ok {
+		return multi.transports
+	}
+	return []Transport{transport}
+}
+
+// Replace the transport used for points sent with Report. Calling
+// SetHttpHost afterwards will install the default http transport again.
+func (self *Errplane) SetHttpTransport(transport Transport) {
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.httpTransport = transport
+}
+
+// Set the maximum size of the datagrams sent by the default udp transport,
+// larger batches are split in several datagrams. DEFAULT_MAX_DATAGRAM_SIZE
+// by default, zero disables splitting.
+func (self *Errplane) SetMaxDatagramSize(size int) error {
+	if size < 0 {
+		return fmt.Errorf("Maximum datagram size cannot be negative")
+	}
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.maxDatagramSize = size
+	for _, transport := range transportTargets(self.udpTransport) {
+		if transport, ok := transport.(*UdpTransport); ok {
+			transport.SetMaxDatagramSize(size)
+		}
+	}
+	return nil
+}
+
+// Replace the transport used for points sent with ReportUDP, Sum and
+// Aggregate. Calling SetUdpAddr afterwards will install the default udp
+// transport again.
+func (self *Errplane) SetUdpTransport(transport Transport) {
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.swapUdpTransport(transport)
+}
+
+// Must be called with the lock held
+func (self *Errplane) swapUdpTransport(transport Transport) {
+	if self.udpTransport != transport {
+		closeBuiltinTransport(self.udpTransport)
+	}
+	self.udpTransport = transport
+}
+
+// Send the points of ReportUDP, Sum and Aggregate as newline delimited json
+// over a persistent tcp connection instead of udp, or over tls if tlsConfig
+// isn't nil. A nil tlsConfig uses the configuration of SetTlsOptions if it
+// was called, see TlsOptions. The connection is reopened with backoff after
+// errors.
+func (self *Errplane) SetTcpAddr(addr string, tlsConfig *tls.Config) error {
+	self.transportLock.RLock()
+	config, timeout := tlsConfig, self.timeout
+	if config == nil {
+		config = self.streamTlsConfig
+	}
+	self.transportLock.RUnlock()
+
+	transport, err := NewTcpTransport(addr, config)
+	if err != nil {
+		return err
+	}
+	transport.stats = &self.stats
+	transport.SetTimeout(timeout)
+
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.tcpAddr = addr
+	self.tcpTlsConfig = tlsConfig
+	self.tcpTransport = transport
+	self.swapUdpTransport(transport)
+	return nil
+}
+
+// close the connections of the transports created by this package, custom
+// transports are left alone
+func closeBuiltinTransport(transport Transport) {
+	switch t := transport.(type) {
+	case *UdpTransport:
+		t.Close()
+	case *StreamTransport:
+		t.Close()
+	case *MultiTransport:
+		t.Close()
+	}
+}
+
+func (self *Errplane) closeTransports() {
+	self.transportLock.RLock()
+	defer self.transportLock.RUnlock()
+	closeBuiltinTransport(self.httpTransport)
+	closeBuiltinTransport(self.udpTransport)
+	if self.ownsHttpClient {
+		self.httpClient.CloseIdleConnections()
+	}
 }
 
 func (self *Errplane) SetProxy(proxy string) error {
@@ -294,30 +995,239 @@ func (self *Errplane) SetProxy(proxy string) error {
 	if err != nil {
 		return err
 	}
-	self.setTransporter(proxyUrl)
+	self.transportLock.Lock()
+	self.proxyUrl = proxyUrl
+	self.transportLock.Unlock()
+	self.setTransporter()
+	return nil
+}
+
+// Use the tls configuration built from options for https requests and tcp
+// transports, e.g. to trust a private CA or to authenticate with a client
+// certificate. A tcp transport installed with SetTcpAddr and a nil
+// tlsConfig is reconnected with the new configuration.
+func (self *Errplane) SetTlsOptions(options TlsOptions) error {
+	tlsConfig, err := options.Config()
+	if err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	self.tlsConfig = tlsConfig
+	self.streamTlsConfig = tlsConfig
+	addr := self.tcpAddr
+	rebuild := self.tcpTransport != nil && self.udpTransport == Transport(self.tcpTransport) && self.tcpTlsConfig == nil
+	self.transportLock.Unlock()
+
+	self.setTransporter()
+	if rebuild {
+		return self.SetTcpAddr(addr, nil)
+	}
 	return nil
 }
 
 func (self *Errplane) SetTimeout(timeout time.Duration) error {
+	self.transportLock.Lock()
 	self.timeout = timeout
-	self.setTransporter(nil)
+	self.transportLock.Unlock()
+	self.setTransporter()
 	return nil
 }
 
-func (self *Errplane) setTransporter(proxyUrl *url.URL) {
-	transporter := &http.Transport{}
-	if proxyUrl != nil {
-		transporter.Proxy = http.ProxyURL(proxyUrl)
+// Use the given client for all http requests. The client is owned by this
+// Errplane object, http.DefaultClient and http.DefaultTransport are never
+// modified. Calling SetProxy or SetTimeout afterwards will replace the
+// client with a new one.
+func (self *Errplane) SetHttpClient(client *http.Client) {
+	self.swapHttpClient(client, false)
+}
+
+// install the client, the idle connections of the previous one are closed
+// if it was built by setTransporter
+func (self *Errplane) swapHttpClient(client *http.Client, owned bool) {
+	self.transportLock.Lock()
+	previous, ownedPrevious := self.httpClient, self.ownsHttpClient
+	self.httpClient = client
+	self.ownsHttpClient = owned
+	self.transportLock.Unlock()
+	self.resetHttpTransport()
+	if ownedPrevious && previous != client {
+		previous.CloseIdleConnections()
 	}
-	transporter.Dial = func(network, addr string) (net.Conn, error) {
-		conn, err := net.DialTimeout(network, addr, self.timeout)
-		if err != nil {
-			return nil, err
+}
+
+// Set the policy used to retry failed http writes, DEFAULT_RETRY_POLICY is
+// used by default. Use the zero RetryPolicy to disable retries.
+func (self *Errplane) SetRetryPolicy(policy RetryPolicy) error {
+	if err := validateRetryPolicy(policy); err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	self.retryPolicy = policy
+	self.transportLock.Unlock()
+	self.resetHttpTransport()
+	return nil
+}
+
+// Compress http request bodies of at least threshold bytes, e.g. with
+// GzipCompressor{} and DEFAULT_COMPRESSION_THRESHOLD. A nil compressor
+// disables compression, which is the default.
+func (self *Errplane) SetCompression(compressor Compressor, threshold int) error {
+	if err := validateCompression(compressor, threshold); err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	self.compressor = compressor
+	self.compressionMin = threshold
+	self.transportLock.Unlock()
+	self.resetHttpTransport()
+	return nil
+}
+
+// Set the policy used when the queue of points waiting to be sent is full,
+// the timeout is only used by OverflowBlockTimeout. The default policy is
+// OverflowBlock.
+func (self *Errplane) SetOverflowPolicy(policy OverflowPolicy, timeout time.Duration) error {
+	if err := validateOverflowPolicy(policy, timeout); err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.overflowPolicy = policy
+	self.overflowTimeout = timeout
+	return nil
+}
+
+// Check the dimensions and context of every point against the rules, e.g.
+// DEFAULT_DIMENSION_RULES. Depending on the mode invalid points are
+// rejected with an error or sanitized. Nothing is checked by default.
+func (self *Errplane) SetDimensionRules(rules DimensionRules) error {
+	if err := validateDimensionRules(rules); err != nil {
+		return err
+	}
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.dimensionRules = &rules
+	return nil
+}
+
+// Limit the number of distinct dimension combinations per metric, see
+// CardinalityLimit. Points over the limit are counted in
+// ClientStats.CardinalityLimited.
+func (self *Errplane) SetCardinalityLimit(limit CardinalityLimit) error {
+	if err := validateCardinalityLimit(limit); err != nil {
+		return err
+	}
+	cardinality := newCardinalityLimiter(limit, self.clock)
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.cardinality = cardinality
+	return nil
+}
+
+// Aggregate Sum and Aggregate points in process instead of sending every
+// call. Sums are added up per metric, context and dimensions and sent once
+// per flush interval. Aggregates are sent as the derived metrics
+// <metric>.count, <metric>.min, <metric>.max, <metric>.mean and <metric>.sum
+// using ReportUDP.
+func (self *Errplane) EnablePreAggregation() {
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	if self.aggregator == nil {
+		self.aggregator = newAggregator()
+	}
+}
+
+func validateOverflowPolicy(policy OverflowPolicy, timeout time.Duration) error {
+	if policy < OverflowBlock || policy > OverflowBlockTimeout {
+		return fmt.Errorf("Unknown overflow policy %d", policy)
+	}
+	if policy == OverflowBlockTimeout && timeout <= 0 {
+		return fmt.Errorf("Overflow timeout must be positive")
+	}
+	return nil
+}
+
+// Keep batches that couldn't be delivered because of a retryable error in an
+// on-disk spool, and replay them every config.ReplayInterval until they are
+// delivered. Batches spooled by a previous process are replayed too.
+func (self *Errplane) EnableSpool(config SpoolConfig) error {
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	if self.spool != nil {
+		return fmt.Errorf("Spool is already enabled")
+	}
+	spool, err := openSpool(config)
+	if err != nil {
+		return err
+	}
+	self.spool = spool
+	go self.replaySpool(spool)
+	return nil
+}
+
+func (self *Errplane) replaySpool(spool *spool) {
+	for self.sleep(spool.config.ReplayInterval) {
+		// an open breaker fails the replay with ErrCircuitOpen, the operations
+		// stay spooled until the next round
+		_, err := spool.replay(self.replay, self.dropReplayed)
+		if err != nil && err != errReplayStopped && err != ErrCircuitOpen {
+			self.handleError(fmt.Errorf("Error while replaying the spool. Error: %s", err))
+		}
+	}
+	spool.close()
+}
+
+// send a spooled operation, subject to the rate limit of the transport.
+// Replays wait for the budget instead of dropping spooled points.
+func (self *Errplane) replay(postType PostType, operation *WriteOperation) error {
+	self.transportLock.RLock()
+	limiter := self.rateLimiters[postType]
+	self.transportLock.RUnlock()
+	if wait := limiter.reserve(operation); wait > 0 && !self.sleep(wait) {
+		return errReplayStopped
+	}
+	if self.isClosed() {
+		return errReplayStopped
+	}
+	if err := self.send(postType, operation); err != nil {
+		var partial *PartialSendError
+		if errors.As(err, &partial) {
+			atomic.AddUint64(&self.stats.flushed, uint64(operation.pointCount()-partial.Remaining.pointCount()))
 		}
-		conn.SetDeadline(time.Now().Add(self.timeout))
-		return conn, nil
+		return err
 	}
-	http.DefaultTransport = transporter
+	atomic.AddUint64(&self.stats.flushed, uint64(operation.pointCount()))
+	return nil
+}
+
+// report a spooled operation that can't be delivered
+func (self *Errplane) dropReplayed(postType PostType, operation *WriteOperation, err error) {
+	deliveryErr := &DeliveryError{
+		Transport: postType.String(),
+		BatchSize: operation.pointCount(),
+		Err:       err,
+	}
+	self.stats.addFailed(postType, deliveryErr.BatchSize)
+	self.handleError(deliveryErr)
+}
+
+func (self *Errplane) setTransporter() {
+	self.transportLock.RLock()
+	timeout, tlsConfig, proxyUrl := self.timeout, self.tlsConfig, self.proxyUrl
+	self.transportLock.RUnlock()
+	// keep the idle connection and tls handshake timeouts of the default
+	// transport, proxies are only used if SetProxy was called
+	transporter := http.DefaultTransport.(*http.Transport).Clone()
+	transporter.TLSClientConfig = tlsConfig
+	transporter.Proxy = nil
+	if proxyUrl != nil {
+		transporter.Proxy = http.ProxyURL(proxyUrl)
+	}
+	transporter.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	self.swapHttpClient(&http.Client{
+		Transport: transporter,
+		Timeout:   timeout,
+	}, true)
 }
 
 // Start a goroutine that will post runtime stats to errplane, stats include memory usage, garbage collection, number of goroutines, etc.
@@ -327,31 +1237,30 @@ func (self *Errplane) setTransporter(proxyUrl *url.URL) {
 //   dimensions: all points will be reported with the given dimensions
 //   sleep: the sampling frequency
 func (self *Errplane) ReportRuntimeStats(prefix, context string, dimensions Dimensions, sleep time.Duration) {
-	if self.runtimeStatsRunning {
-		fmt.Fprintf(os.Stderr, "Runtime stats is already running\n")
+	if !atomic.CompareAndSwapInt32(&self.runtimeStatsRunning, 0, 1) {
+		self.warnf("Runtime stats is already running")
 		return
 	}
 
-	self.runtimeStatsRunning = true
 	go self.reportRuntimeStats(prefix, context, dimensions, sleep)
 }
 
 func (self *Errplane) StopRuntimeStatsReporting(prefix, context string, dimensions Dimensions, sleep time.Duration) {
-	self.runtimeStatsRunning = false
+	atomic.StoreInt32(&self.runtimeStatsRunning, 0)
 }
 
 func (self *Errplane) reportRuntimeStats(prefix, context string, dimensions Dimensions, sleep time.Duration) {
 	memStats := &runtime.MemStats{}
-	lastSampleTime := time.Now()
+	lastSampleTime := self.clock.Now()
 	var lastPauseNs uint64 = 0
 	var lastNumGc uint32 = 0
 
 	nsInMs := float64(time.Millisecond)
 
-	for self.runtimeStatsRunning {
+	for atomic.LoadInt32(&self.runtimeStatsRunning) == 1 && !self.isClosed() {
 		runtime.ReadMemStats(memStats)
 
-		now := time.Now()
+		now := self.clock.Now()
 
 		self.Report(fmt.Sprintf("%s.goroutines", prefix), float64(runtime.NumGoroutine()), now, context, dimensions)
 		self.Report(fmt.Sprintf("%s.memory.heap.objects", prefix), float64(memStats.HeapObjects), now, context, dimensions)
@@ -378,7 +1287,7 @@ func (self *Errplane) reportRuntimeStats(prefix, context string, dimensions Dime
 		// get the individual pause times
 		if countGc > 0 {
 			if countGc > 256 {
-				fmt.Fprintf(os.Stderr, "We're missing some gc pause times")
+				self.warnf("We're missing some gc pause times")
 				countGc = 256
 			}
 
@@ -393,7 +1302,7 @@ func (self *Errplane) reportRuntimeStats(prefix, context string, dimensions Dime
 		lastNumGc = memStats.NumGC
 		lastSampleTime = now
 
-		time.Sleep(sleep)
+		self.sleep(sleep)
 	}
 }
 
@@ -407,9 +1316,40 @@ func (self *Errplane) sendUdpPayload(metricType, metric string, value float64, c
 }
 
 func (self *Errplane) sendCommon(metricType, metric string, value float64, timestamp *time.Time, context string, dimensions Dimensions, postType PostType) error {
-	if err := verifyMetricName(metric); err != nil {
+	metric = self.scopedMetric(metric)
+	dimensions = self.scopedDimensions(dimensions)
+
+	// the final flush waits for the points that passed this check
+	self.closeLock.RLock()
+	defer self.closeLock.RUnlock()
+	if self.isClosed() {
+		return ErrClosed
+	}
+	self.transportLock.RLock()
+	namePolicy, rules, cardinality, aggregator := self.namePolicy, self.dimensionRules, self.cardinality, self.aggregator
+	self.transportLock.RUnlock()
+
+	if self.internal {
+		namePolicy.ReservedPrefixes = nil
+	}
+	if err := namePolicy.Validate(metric); err != nil {
 		return err
 	}
+	if rules != nil {
+		var err error
+		if context, dimensions, err = rules.apply(context, dimensions); err != nil {
+			return err
+		}
+	}
+	if cardinality != nil {
+		var ok bool
+		if dimensions, ok = cardinality.check(metric, dimensions); !ok {
+			atomic.AddUint64(&self.stats.cardinalityLimited, 1)
+			if dimensions == nil {
+				return ErrCardinalityLimit
+			}
+		}
+	}
 	point := &JsonPoint{
 		Value:      value,
 		Context:    context,
@@ -420,6 +1360,14 @@ func (self *Errplane) sendCommon(metricType, metric string, value float64, times
 		point.Time = timestamp.Unix()
 	}
 
+	if metricType == "h" {
+		self.histograms.add(metric, point)
+		return nil
+	}
+	if postType == UDP && aggregator != nil && aggregator.add(metricType, metric, point) {
+		return nil
+	}
+
 	data := &WriteOperation{
 		Operation: metricType,
 		Writes: []*JsonPoints{
@@ -429,10 +1377,81 @@ func (self *Errplane) sendCommon(metricType, metric string, value float64, times
 			},
 		},
 	}
-	self.msgChan <- &ErrplanePost{postType, data}
+	return self.enqueue(&ErrplanePost{postType, data})
+}
+
+func (self *Errplane) enqueue(post *ErrplanePost) error {
+	count := int64(countPoints([]*ErrplanePost{post}))
+	atomic.AddInt64(&self.pendingPoints, count)
+	err := self.push(post)
+	if err != nil {
+		atomic.AddInt64(&self.pendingPoints, -count)
+		return err
+	}
+	atomic.AddUint64(&self.stats.enqueued, uint64(count))
 	return nil
 }
 
+func (self *Errplane) push(post *ErrplanePost) error {
+	select {
+	case self.msgChan <- post:
+		return nil
+	default:
+	}
+
+	self.transportLock.RLock()
+	policy, timeout := self.overflowPolicy, self.overflowTimeout
+	self.transportLock.RUnlock()
+
+	switch policy {
+	case OverflowDropNewest:
+		self.drop(post)
+		return ErrQueueFull
+	case OverflowDropOldest:
+		for {
+			select {
+			case old := <-self.msgChan:
+				self.drop(old)
+				atomic.AddInt64(&self.pendingPoints, -int64(countPoints([]*ErrplanePost{old})))
+			default:
+			}
+			select {
+			case self.msgChan <- post:
+				return nil
+			default:
+			}
+		}
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case self.msgChan <- post:
+			return nil
+		case <-self.closing:
+			return ErrClosed
+		case <-timer.C:
+			self.drop(post)
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case self.msgChan <- post:
+		return nil
+	case <-self.closing:
+		return ErrClosed
+	}
+}
+
+func (self *Errplane) drop(post *ErrplanePost) {
+	atomic.AddUint64(&self.droppedPoints, uint64(countPoints([]*ErrplanePost{post})))
+}
+
+// The number of points that were dropped because the queue was full
+func (self *Errplane) DroppedPoints() uint64 {
+	return atomic.LoadUint64(&self.droppedPoints)
+}
+
 func (self *Errplane) ReportUDP(metric string, value float64, context string, dimensions Dimensions) error {
 	return self.sendUdpPayload("r", metric, value, context, dimensions)
 }
@@ -441,18 +1460,34 @@ func (self *Errplane) Aggregate(metric string, value float64, context string, di
 	return self.sendUdpPayload("t", metric, value, context, dimensions)
 }
 
+// Record the value in a histogram, the configured percentiles (see
+// SetPercentiles) are sent once per flush interval as <metric>.p50,
+// <metric>.p90, etc. using ReportUDP. NaN and infinite values are rejected.
+func (self *Errplane) Histogram(metric string, value float64, context string, dimensions Dimensions) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("Histogram values must be finite, got %v", value)
+	}
+	return self.sendUdpPayload("h", metric, value, context, dimensions)
+}
+
+// Set the percentiles sent for every histogram, DEFAULT_PERCENTILES by
+// default. Percentiles must be between 0 and 1.
+func (self *Errplane) SetPercentiles(percentiles ...float64) error {
+	return self.histograms.setPercentiles(percentiles)
+}
+
 func (self *Errplane) Sum(metric string, value float64, context string, dimensions Dimensions) error {
 	return self.sendUdpPayload("c", metric, float64(value), context, dimensions)
 }
 
-func verifyMetricName(name string) error {
-	if len(name) > 255 {
-		return fmt.Errorf("Metric names must be less than 255 characters")
-	}
-
-	if !METRIC_REGEX.MatchString(name) {
-		return fmt.Errorf("Invalid metric name %s. See docs for valid metric names", name)
+// Set the rules metric names are checked against, DEFAULT_NAME_POLICY by
+// default. Points with invalid names are rejected with a *NameError.
+func (self *Errplane) SetNamePolicy(policy NamePolicy) error {
+	if err := validateNamePolicy(policy); err != nil {
+		return err
 	}
-
+	self.transportLock.Lock()
+	defer self.transportLock.Unlock()
+	self.namePolicy = policy
 	return nil
 }
@@ -0,0 +1,89 @@
+package errplane
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// BreakerPolicy configures the circuit breaker of a transport. After
+// Failures consecutive retryable errors the breaker opens and batches fail
+// with ErrCircuitOpen without touching the network. Once Cooldown has
+// passed a single batch is let through to probe the collector, it closes
+// the breaker if it succeeds and opens it again otherwise. Zero Failures
+// disables the breaker.
+type BreakerPolicy struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+var DEFAULT_BREAKER_POLICY = BreakerPolicy{
+	Failures: 5,
+	Cooldown: 30 * time.Second,
+}
+
+type circuitOpenError struct{}
+
+func (self circuitOpenError) Error() string {
+	return "Circuit breaker is open"
+}
+
+// the batch can be spooled and sent once the collector is back
+func (self circuitOpenError) Retryable() bool {
+	return true
+}
+
+// Returned for batches that weren't sent because the circuit breaker of
+// the transport is open
+var ErrCircuitOpen error = circuitOpenError{}
+
+func validateBreakerPolicy(policy BreakerPolicy) error {
+	if policy.Failures < 0 || policy.Cooldown < 0 {
+		return fmt.Errorf("Breaker policy cannot have negative values")
+	}
+	return nil
+}
+
+type circuitBreaker struct {
+	policy BreakerPolicy
+	clock  Clock
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(policy BreakerPolicy, clock Clock) *circuitBreaker {
+	return &circuitBreaker{policy: policy, clock: clock}
+}
+
+// returns ErrCircuitOpen if the batch shouldn't be sent
+func (self *circuitBreaker) allow() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.policy.Failures == 0 || self.failures < self.policy.Failures {
+		return nil
+	}
+	if self.probing || self.clock.Now().Before(self.openUntil) {
+		return ErrCircuitOpen
+	}
+	self.probing = true
+	return nil
+}
+
+// record the result of a batch let through by allow, errors that aren't
+// retryable mean the collector is reachable and count as successes
+func (self *circuitBreaker) record(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.probing = false
+	if err == nil || !isRetryable(err) {
+		self.failures = 0
+		return
+	}
+	self.failures++
+	if self.policy.Failures > 0 && self.failures >= self.policy.Failures {
+		self.openUntil = self.clock.Now().Add(self.policy.Cooldown)
+	}
+}
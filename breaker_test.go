@@ -0,0 +1,105 @@
+package errplane
+
+import (
+	"context"
+	"errors"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type BreakerSuite struct{}
+
+var _ = Suite(&BreakerSuite{})
+
+func (s *BreakerSuite) TestOpensAfterConsecutiveFailures(c *C) {
+	clock := &fixedClock{now: time.Now()}
+	breaker := newCircuitBreaker(BreakerPolicy{Failures: 3, Cooldown: time.Minute}, clock)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(breaker.allow(), IsNil)
+		breaker.record(errCollectorDown)
+	}
+	c.Assert(breaker.allow(), Equals, ErrCircuitOpen)
+	c.Assert(isRetryable(ErrCircuitOpen), Equals, true)
+
+	// a single probe is let through once the cooldown is over
+	clock.now = clock.now.Add(time.Minute)
+	c.Assert(breaker.allow(), IsNil)
+	c.Assert(breaker.allow(), Equals, ErrCircuitOpen)
+
+	// a failed probe opens the breaker again
+	breaker.record(errCollectorDown)
+	c.Assert(breaker.allow(), Equals, ErrCircuitOpen)
+
+	clock.now = clock.now.Add(time.Minute)
+	c.Assert(breaker.allow(), IsNil)
+	breaker.record(nil)
+	c.Assert(breaker.allow(), IsNil)
+	c.Assert(breaker.allow(), IsNil)
+}
+
+func (s *BreakerSuite) TestIgnoresPermanentErrors(c *C) {
+	breaker := newCircuitBreaker(BreakerPolicy{Failures: 1, Cooldown: time.Minute}, realClock{})
+	breaker.record(errors.New("bad request"))
+	c.Assert(breaker.allow(), IsNil)
+
+	disabled := newCircuitBreaker(BreakerPolicy{}, realClock{})
+	disabled.record(errCollectorDown)
+	c.Assert(disabled.allow(), IsNil)
+}
+
+func (s *BreakerSuite) TestSkipsTheTransportWhileOpen(c *C) {
+	transport := &recordingTransport{err: errCollectorDown}
+	recorder := &errorRecorder{}
+	options := append(requiredOptions, WithHttpTransport(transport), WithErrorHandler(recorder.handle),
+		WithBreakerPolicy(BreakerPolicy{Failures: 2, Cooldown: time.Hour}))
+	ep, err := NewWithOptions(options...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	for i := 0; i < 4; i++ {
+		c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+		c.Assert(ep.Flush(context.Background()), NotNil)
+	}
+	c.Assert(transport.sent(), HasLen, 2)
+	c.Assert(ep.Stats().Failed["http"], Equals, uint64(4))
+
+	c.Assert(recorder.errors, HasLen, 4)
+	deliveryErr, ok := recorder.errors[3].(*DeliveryError)
+	c.Assert(ok, Equals, true)
+	c.Assert(deliveryErr.Err, Equals, ErrCircuitOpen)
+	c.Assert(deliveryErr.Retryable, Equals, true)
+
+	// udp has its own breaker
+	c.Assert(ep.breaker(UDP).allow(), IsNil)
+}
+
+func (s *BreakerSuite) TestReplaysOtherTransportsWhileOpen(c *C) {
+	transport := &recordingTransport{}
+	recorder := &errorRecorder{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(&recordingTransport{err: errCollectorDown}),
+		WithUdpTransport(transport),
+		WithErrorHandler(recorder.handle),
+		WithBreakerPolicy(BreakerPolicy{Failures: 1, Cooldown: time.Hour}),
+		WithSpool(SpoolConfig{Dir: c.MkDir(), ReplayInterval: 20 * time.Millisecond}),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	ep.breaker(HTTP).record(errCollectorDown)
+	c.Assert(ep.spool.append(UDP, spoolOperation("some_metric")), IsNil)
+	waitFor(c, func() bool { return len(transport.sent()) == 1 })
+	waitFor(c, func() bool { return ep.spool.bytes() == 0 })
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	c.Assert(recorder.errors, HasLen, 0)
+}
+
+func (s *BreakerSuite) TestValidatesPolicy(c *C) {
+	_, err := NewWithOptions(append(requiredOptions, WithBreakerPolicy(BreakerPolicy{Failures: -1}))...)
+	c.Assert(err, NotNil)
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	c.Assert(ep.SetBreakerPolicy(BreakerPolicy{Cooldown: -time.Second}), NotNil)
+}
@@ -0,0 +1,122 @@
+package errplane
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CardinalityPolicy decides what happens to points of a metric that is
+// over its CardinalityLimit
+type CardinalityPolicy int
+
+const (
+	// Replace the value of every dimension with OVERFLOW_DIMENSION_VALUE, so
+	// all new combinations end up in a single series
+	CardinalityOverflow CardinalityPolicy = iota
+	// Drop the point, Report and friends return ErrCardinalityLimit
+	CardinalityDrop
+)
+
+const (
+	OVERFLOW_DIMENSION_VALUE   = "__overflow__"
+	DEFAULT_CARDINALITY_WINDOW = time.Hour
+)
+
+// CardinalityLimit caps the number of distinct dimension combinations per
+// metric within a window. Combinations seen before keep being accepted,
+// the counts start over with every window.
+type CardinalityLimit struct {
+	// the default limit of every metric, zero means unlimited
+	MaxSeries int
+	// per metric limits that take precedence over MaxSeries, zero makes a
+	// metric unlimited. The map is copied.
+	Metrics map[string]int
+	// DEFAULT_CARDINALITY_WINDOW if zero
+	Window time.Duration
+	Policy CardinalityPolicy
+}
+
+func validateCardinalityLimit(limit CardinalityLimit) error {
+	if limit.MaxSeries < 0 || limit.Window < 0 {
+		return fmt.Errorf("Cardinality limit cannot have negative values")
+	}
+	for metric, max := range limit.Metrics {
+		if max < 0 {
+			return fmt.Errorf("Cardinality limit of %s cannot be negative", metric)
+		}
+	}
+	if limit.Policy != CardinalityOverflow && limit.Policy != CardinalityDrop {
+		return fmt.Errorf("Unknown cardinality policy %d", limit.Policy)
+	}
+	return nil
+}
+
+type cardinalityLimiter struct {
+	limit CardinalityLimit
+	clock Clock
+
+	lock        sync.Mutex
+	windowStart time.Time
+	series      map[string]map[string]bool
+}
+
+func newCardinalityLimiter(limit CardinalityLimit, clock Clock) *cardinalityLimiter {
+	if limit.Window == 0 {
+		limit.Window = DEFAULT_CARDINALITY_WINDOW
+	}
+	// don't share the map with the caller
+	metrics := make(map[string]int, len(limit.Metrics))
+	for metric, max := range limit.Metrics {
+		metrics[metric] = max
+	}
+	limit.Metrics = metrics
+	return &cardinalityLimiter{
+		limit:       limit,
+		clock:       clock,
+		windowStart: clock.Now(),
+		series:      make(map[string]map[string]bool),
+	}
+}
+
+func (self *cardinalityLimiter) maxSeries(metric string) int {
+	if max, ok := self.limit.Metrics[metric]; ok {
+		return max
+	}
+	return self.limit.MaxSeries
+}
+
+// Returns the dimensions to send the point with and false if the point is
+// over the limit. The dimensions are nil if the point should be dropped.
+func (self *cardinalityLimiter) check(metric string, dimensions Dimensions) (Dimensions, bool) {
+	max := self.maxSeries(metric)
+	if max == 0 {
+		return dimensions, true
+	}
+	key := seriesKey("", "", dimensions)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if now := self.clock.Now(); now.Sub(self.windowStart) >= self.limit.Window {
+		self.windowStart = now
+		self.series = make(map[string]map[string]bool)
+	}
+	seen := self.series[metric]
+	if seen == nil {
+		seen = make(map[string]bool)
+		self.series[metric] = seen
+	}
+	if seen[key] || len(seen) < max {
+		seen[key] = true
+		return dimensions, true
+	}
+
+	if self.limit.Policy == CardinalityDrop {
+		return nil, false
+	}
+	overflow := make(Dimensions, len(dimensions))
+	for name := range dimensions {
+		overflow[name] = OVERFLOW_DIMENSION_VALUE
+	}
+	return overflow, false
+}
@@ -0,0 +1,83 @@
+package errplane
+
+import (
+	"context"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type CardinalitySuite struct{}
+
+var _ = Suite(&CardinalitySuite{})
+
+func (s *CardinalitySuite) TestCollapsesNewSeriesIntoTheOverflowBucket(c *C) {
+	limiter := newCardinalityLimiter(CardinalityLimit{MaxSeries: 2}, &fixedClock{now: time.Now()})
+
+	for _, id := range []string{"1", "2", "1"} {
+		dimensions, ok := limiter.check("requests", Dimensions{"request_id": id})
+		c.Assert(ok, Equals, true)
+		c.Assert(dimensions, DeepEquals, Dimensions{"request_id": id})
+	}
+	dimensions, ok := limiter.check("requests", Dimensions{"request_id": "3", "host": "web1"})
+	c.Assert(ok, Equals, false)
+	c.Assert(dimensions, DeepEquals, Dimensions{"request_id": OVERFLOW_DIMENSION_VALUE, "host": OVERFLOW_DIMENSION_VALUE})
+
+	// other metrics have their own budget
+	_, ok = limiter.check("other", Dimensions{"request_id": "3"})
+	c.Assert(ok, Equals, true)
+}
+
+func (s *CardinalitySuite) TestStartsOverEveryWindow(c *C) {
+	clock := &fixedClock{now: time.Now()}
+	limiter := newCardinalityLimiter(CardinalityLimit{MaxSeries: 1, Window: time.Minute, Policy: CardinalityDrop}, clock)
+
+	_, ok := limiter.check("requests", Dimensions{"request_id": "1"})
+	c.Assert(ok, Equals, true)
+	dimensions, ok := limiter.check("requests", Dimensions{"request_id": "2"})
+	c.Assert(ok, Equals, false)
+	c.Assert(dimensions, IsNil)
+
+	clock.now = clock.now.Add(time.Minute)
+	_, ok = limiter.check("requests", Dimensions{"request_id": "2"})
+	c.Assert(ok, Equals, true)
+}
+
+func (s *CardinalitySuite) TestPerMetricLimits(c *C) {
+	limit := CardinalityLimit{MaxSeries: 1, Metrics: map[string]int{"unlimited": 0, "roomy": 3}}
+	limiter := newCardinalityLimiter(limit, &fixedClock{now: time.Now()})
+
+	for i := 0; i < 5; i++ {
+		_, ok := limiter.check("unlimited", Dimensions{"id": fmt.Sprint(i)})
+		c.Assert(ok, Equals, true)
+		_, ok = limiter.check("roomy", Dimensions{"id": fmt.Sprint(i)})
+		c.Assert(ok, Equals, i < 3)
+		_, ok = limiter.check("default", Dimensions{"id": fmt.Sprint(i)})
+		c.Assert(ok, Equals, i < 1)
+	}
+}
+
+func (s *CardinalitySuite) TestCopiesPerMetricLimits(c *C) {
+	metrics := map[string]int{"roomy": 3}
+	limiter := newCardinalityLimiter(CardinalityLimit{MaxSeries: 1, Metrics: metrics}, &fixedClock{now: time.Now()})
+	metrics["roomy"] = 1
+	c.Assert(limiter.maxSeries("roomy"), Equals, 3)
+}
+
+func (s *CardinalitySuite) TestWithCardinalityLimit(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport),
+		WithCardinalityLimit(CardinalityLimit{MaxSeries: 1, Policy: CardinalityDrop}))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("requests", 1, time.Now(), "", Dimensions{"request_id": "1"}), IsNil)
+	c.Assert(ep.Report("requests", 1, time.Now(), "", Dimensions{"request_id": "2"}), Equals, ErrCardinalityLimit)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	c.Assert(pointsByName(transport.sent(), "")["requests"], HasLen, 1)
+	c.Assert(ep.Stats().CardinalityLimited, Equals, uint64(1))
+
+	c.Assert(ep.SetCardinalityLimit(CardinalityLimit{MaxSeries: -1}), NotNil)
+	c.Assert(ep.SetCardinalityLimit(CardinalityLimit{Policy: CardinalityPolicy(42)}), ErrorMatches, "Unknown cardinality policy 42")
+}
@@ -0,0 +1,59 @@
+package errplane
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+)
+
+// Bodies smaller than this aren't worth compressing
+const DEFAULT_COMPRESSION_THRESHOLD = 1024
+
+// Compressor compresses http request bodies, Encoding is sent as the
+// Content-Encoding header. GzipCompressor is the built-in implementation,
+// other encodings such as zstd can be plugged in by implementing it, e.g.
+// on top of github.com/klauspost/compress/zstd.
+type Compressor interface {
+	Encoding() string
+	Compress(body []byte) ([]byte, error)
+}
+
+// GzipCompressor compresses bodies with compress/gzip at the given level,
+// the zero value uses gzip.DefaultCompression.
+type GzipCompressor struct {
+	Level int
+}
+
+func (self GzipCompressor) Encoding() string {
+	return "gzip"
+}
+
+func (self GzipCompressor) Compress(body []byte) ([]byte, error) {
+	level := self.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func validateCompression(compressor Compressor, threshold int) error {
+	if threshold < 0 {
+		return fmt.Errorf("Compression threshold cannot be negative")
+	}
+	if compressor != nil && compressor.Encoding() == "" {
+		return fmt.Errorf("Compressor must have an encoding")
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package errplane
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+type CompressionSuite struct{}
+
+var _ = Suite(&CompressionSuite{})
+
+type compressedRequest struct {
+	encoding string
+	writes   []*JsonPoints
+}
+
+func newCompressionServer(c *C) (*httptest.Server, chan compressedRequest) {
+	requests := make(chan compressedRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			reader, err := gzip.NewReader(req.Body)
+			c.Check(err, IsNil)
+			body = reader
+		}
+		writes := []*JsonPoints{}
+		c.Check(json.NewDecoder(body).Decode(&writes), IsNil)
+		requests <- compressedRequest{req.Header.Get("Content-Encoding"), writes}
+		writer.WriteHeader(201)
+	}))
+	return server, requests
+}
+
+func operationOfSize(names int) *WriteOperation {
+	operation := &WriteOperation{}
+	for i := 0; i < names; i++ {
+		operation.Writes = append(operation.Writes, &JsonPoints{Name: strings.Repeat("a", 100)})
+	}
+	return operation
+}
+
+func (s *CompressionSuite) TestCompressesBodiesAboveTheThreshold(c *C) {
+	server, requests := newCompressionServer(c)
+	defer server.Close()
+	transport := NewHttpTransport(server.URL, nil)
+	c.Assert(transport.SetCompression(GzipCompressor{}, 1024), IsNil)
+
+	c.Assert(transport.Send(operationOfSize(20)), IsNil)
+	request := <-requests
+	c.Assert(request.encoding, Equals, "gzip")
+	c.Assert(request.writes, HasLen, 20)
+
+	c.Assert(transport.Send(operationOfSize(1)), IsNil)
+	request = <-requests
+	c.Assert(request.encoding, Equals, "")
+	c.Assert(request.writes, HasLen, 1)
+}
+
+func (s *CompressionSuite) TestDoesNotCompressByDefault(c *C) {
+	server, requests := newCompressionServer(c)
+	defer server.Close()
+
+	c.Assert(NewHttpTransport(server.URL, nil).Send(operationOfSize(20)), IsNil)
+	c.Assert((<-requests).encoding, Equals, "")
+}
+
+func (s *CompressionSuite) TestWithCompression(c *C) {
+	server, requests := newCompressionServer(c)
+	defer server.Close()
+	options := append(requiredOptions, WithCompression(GzipCompressor{Level: gzip.BestSpeed}, 0),
+		WithHttpScheme("http"), WithHttpHost(strings.TrimPrefix(server.URL, "http://")))
+	ep, err := NewWithOptions(options...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	request := <-requests
+	c.Assert(request.encoding, Equals, "gzip")
+	c.Assert(request.writes[0].Name, Equals, "some_metric")
+}
+
+func (s *CompressionSuite) TestValidatesCompression(c *C) {
+	c.Assert(NewHttpTransport("", nil).SetCompression(GzipCompressor{}, -1), ErrorMatches, ".*negative.*")
+	c.Assert(NewHttpTransport("", nil).SetCompression(nil, 0), IsNil)
+
+	transport := NewHttpTransport("", nil)
+	c.Assert(transport.SetCompression(GzipCompressor{Level: 42}, 0), IsNil)
+	c.Assert(transport.Send(&WriteOperation{}), ErrorMatches, "Cannot compress.*")
+}
@@ -0,0 +1,109 @@
+package errplane
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The largest payload that fits in a single ethernet frame without
+// fragmentation, see SetMaxDatagramSize
+const DEFAULT_MAX_DATAGRAM_SIZE = 1432
+
+// DatagramTooLargeError is returned by UdpTransport when some points are
+// too large to fit in a datagram on their own. The other points of the
+// operation are still sent.
+type DatagramTooLargeError struct {
+	// the number of points that weren't sent
+	Points  int
+	MaxSize int
+}
+
+func (self *DatagramTooLargeError) Error() string {
+	return fmt.Sprintf("%d points don't fit in a %d bytes datagram", self.Points, self.MaxSize)
+}
+
+// PartialSendError is returned by UdpTransport when a write fails after
+// some datagrams of the operation were sent. Remaining holds the points that
+// weren't sent, sending the whole operation again would duplicate the others.
+type PartialSendError struct {
+	Remaining *WriteOperation
+	Err       error
+}
+
+func (self *PartialSendError) Error() string {
+	return fmt.Sprintf("Failed to send %d points. Error: %s", self.Remaining.pointCount(), self.Err)
+}
+
+func (self *PartialSendError) Unwrap() error {
+	return self.Err
+}
+
+func (self *PartialSendError) Retryable() bool {
+	return isRetryable(self.Err)
+}
+
+// a marshaled part of an operation
+type datagram struct {
+	operation *WriteOperation
+	buf       []byte
+}
+
+// Marshal the operation into datagrams of at most maxSize bytes, splitting
+// its points in halves until every half fits. Returns the points that are
+// too large on their own. A maxSize of zero disables splitting.
+func splitOperation(data *WriteOperation, maxSize int) ([]*datagram, []*WriteOperation, error) {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot marshal %#v. Error: %s", data, err)
+	}
+	if maxSize <= 0 || len(buf) <= maxSize {
+		return []*datagram{{data, buf}}, nil, nil
+	}
+	if data.pointCount() <= 1 {
+		return nil, []*WriteOperation{data}, nil
+	}
+
+	first, second := halveOperation(data)
+	datagrams, tooLarge, err := splitOperation(first, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, restTooLarge, err := splitOperation(second, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(datagrams, rest...), append(tooLarge, restTooLarge...), nil
+}
+
+// Merge the points of the operations into one operation
+func joinOperations(data *WriteOperation, operations []*WriteOperation) *WriteOperation {
+	joined := &WriteOperation{Database: data.Database, ApiKey: data.ApiKey, Operation: data.Operation}
+	for _, operation := range operations {
+		joined.Writes = append(joined.Writes, operation.Writes...)
+	}
+	return joined
+}
+
+// Split the points of the operation in two operations with the same number
+// of points (give or take one), keeping the order of the points.
+func halveOperation(data *WriteOperation) (*WriteOperation, *WriteOperation) {
+	half := data.pointCount() / 2
+	first := &WriteOperation{Database: data.Database, ApiKey: data.ApiKey, Operation: data.Operation}
+	second := &WriteOperation{Database: data.Database, ApiKey: data.ApiKey, Operation: data.Operation}
+
+	seen := 0
+	for _, points := range data.Writes {
+		switch {
+		case seen >= half:
+			second.Writes = append(second.Writes, points)
+		case seen+len(points.Points) <= half:
+			first.Writes = append(first.Writes, points)
+		default:
+			split := half - seen
+			first.Writes = append(first.Writes, &JsonPoints{Name: points.Name, Points: points.Points[:split]})
+			second.Writes = append(second.Writes, &JsonPoints{Name: points.Name, Points: points.Points[split:]})
+		}
+		seen += len(points.Points)
+	}
+	return first, second
+}
@@ -0,0 +1,216 @@
+package errplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"net"
+	"strings"
+	"time"
+)
+
+type DatagramSuite struct{}
+
+var _ = Suite(&DatagramSuite{})
+
+func largeOperation(metrics, pointsPerMetric int) *WriteOperation {
+	operation := &WriteOperation{Database: "app4you2lovestaging", ApiKey: "some_key", Operation: "c"}
+	for i := 0; i < metrics; i++ {
+		points := &JsonPoints{Name: fmt.Sprintf("metric_%d", i)}
+		for j := 0; j < pointsPerMetric; j++ {
+			points.Points = append(points.Points, &JsonPoint{Value: float64(j), Dimensions: map[string]string{"host": "some_host"}})
+		}
+		operation.Writes = append(operation.Writes, points)
+	}
+	return operation
+}
+
+func (s *DatagramSuite) TestSplitsLargeOperations(c *C) {
+	datagrams, tooLarge, err := splitOperation(largeOperation(3, 50), 512)
+	c.Assert(err, IsNil)
+	c.Assert(tooLarge, HasLen, 0)
+	c.Assert(len(datagrams) > 1, Equals, true)
+
+	values := make(map[string][]float64)
+	for _, datagram := range datagrams {
+		c.Assert(len(datagram.buf) <= 512, Equals, true)
+		operation := &WriteOperation{}
+		c.Assert(json.Unmarshal(datagram.buf, operation), IsNil)
+		c.Assert(operation.pointCount(), Equals, datagram.operation.pointCount())
+		c.Assert(operation.Operation, Equals, "c")
+		c.Assert(operation.ApiKey, Equals, "some_key")
+		for _, points := range operation.Writes {
+			for _, point := range points.Points {
+				values[points.Name] = append(values[points.Name], point.Value)
+			}
+		}
+	}
+	c.Assert(values, HasLen, 3)
+	for _, metricValues := range values {
+		c.Assert(metricValues, HasLen, 50)
+		for i, value := range metricValues {
+			c.Assert(value, Equals, float64(i))
+		}
+	}
+}
+
+func (s *DatagramSuite) TestDoesNotSplitSmallOperations(c *C) {
+	datagrams, _, err := splitOperation(largeOperation(3, 50), 0)
+	c.Assert(err, IsNil)
+	c.Assert(datagrams, HasLen, 1)
+	datagrams, _, err = splitOperation(largeOperation(1, 1), 512)
+	c.Assert(err, IsNil)
+	c.Assert(datagrams, HasLen, 1)
+}
+
+func (s *DatagramSuite) TestPointTooLarge(c *C) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	transport, err := NewUdpTransport(listener.LocalAddr().String())
+	c.Assert(err, IsNil)
+	defer transport.Close()
+	transport.SetMaxDatagramSize(256)
+
+	operation := largeOperation(1, 1)
+	operation.Writes = append(operation.Writes, &JsonPoints{
+		Name:   "huge_metric",
+		Points: []*JsonPoint{{Value: 1, Context: strings.Repeat("x", 300)}},
+	})
+	err = transport.Send(operation)
+	c.Assert(err, FitsTypeOf, &DatagramTooLargeError{})
+	c.Assert(err.(*DatagramTooLargeError).Points, Equals, 1)
+	c.Assert(isRetryable(err), Equals, false)
+
+	// the point that fits is still sent
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := listener.Read(buffer)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(buffer[:n]), "metric_0"), Equals, true)
+}
+
+func (s *DatagramSuite) TestOnlyTooLargePointsFail(c *C) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithUdpAddr(listener.LocalAddr().String()),
+		WithMaxDatagramSize(256),
+		WithErrorHandler(func(error) {}),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.ReportUDP("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.ReportUDP("some_metric", 2, strings.Repeat("x", 300), nil), IsNil)
+	err = ep.Flush(context.Background())
+	c.Assert(err, NotNil)
+	c.Assert(err.(SendErrors)[0].(*DeliveryError).BatchSize, Equals, 1)
+
+	stats := ep.Stats()
+	c.Assert(stats.Flushed, Equals, uint64(1))
+	c.Assert(stats.Failed["udp"], Equals, uint64(1))
+}
+
+// a connection that fails the writes after the first ones
+type failingConn struct {
+	net.Conn
+	writes int
+}
+
+func (self *failingConn) Write(buf []byte) (int, error) {
+	if self.writes == 0 {
+		return 0, errCollectorDown
+	}
+	self.writes--
+	return self.Conn.Write(buf)
+}
+
+// a udp transport whose writes fail after the first datagram, returns the
+// listener that receives the first datagram
+func partiallyFailingTransport(c *C) (*UdpTransport, *net.UDPConn) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+	transport, err := NewUdpTransport(listener.LocalAddr().String())
+	c.Assert(err, IsNil)
+	transport.SetMaxDatagramSize(512)
+	conn, err := net.Dial("udp4", listener.LocalAddr().String())
+	c.Assert(err, IsNil)
+	transport.conn = &failingConn{Conn: conn, writes: 1}
+	return transport, listener
+}
+
+// the number of points in the next datagram received by the listener
+func receivedPoints(c *C, listener *net.UDPConn) int {
+	buffer := make([]byte, 1024)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := listener.Read(buffer)
+	c.Assert(err, IsNil)
+	operation := &WriteOperation{}
+	c.Assert(json.Unmarshal(buffer[:n], operation), IsNil)
+	return operation.pointCount()
+}
+
+func (s *DatagramSuite) TestReportsTheUnsentPoints(c *C) {
+	transport, listener := partiallyFailingTransport(c)
+	defer listener.Close()
+	defer transport.Close()
+
+	err := transport.Send(largeOperation(3, 50))
+	c.Assert(err, FitsTypeOf, &PartialSendError{})
+	c.Assert(isRetryable(err), Equals, true)
+	remaining := err.(*PartialSendError).Remaining
+	c.Assert(remaining.Operation, Equals, "c")
+	c.Assert(remaining.pointCount(), Equals, 150-receivedPoints(c, listener))
+}
+
+func (s *DatagramSuite) TestFailsOverTheUnsentPoints(c *C) {
+	transport, listener := partiallyFailingTransport(c)
+	defer listener.Close()
+	secondary := &recordingTransport{}
+	multi, err := NewMultiTransport(MultiFailover, transport, secondary)
+	c.Assert(err, IsNil)
+	defer transport.Close()
+
+	c.Assert(multi.Send(largeOperation(3, 50)), IsNil)
+	c.Assert(secondary.sent(), HasLen, 1)
+	c.Assert(secondary.sent()[0].pointCount(), Equals, 150-receivedPoints(c, listener))
+}
+
+func (s *DatagramSuite) TestSpoolsTheUnsentPoints(c *C) {
+	transport, listener := partiallyFailingTransport(c)
+	defer listener.Close()
+	defer transport.Close()
+	recorder := &errorRecorder{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithUdpTransport(transport),
+		WithErrorHandler(recorder.handle),
+		WithSpool(SpoolConfig{Dir: c.MkDir(), ReplayInterval: time.Hour}),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	for i := 0; i < 150; i++ {
+		c.Assert(ep.Sum(fmt.Sprintf("metric_%d", i), 1, "", nil), IsNil)
+	}
+	err = ep.Flush(context.Background())
+	c.Assert(err, NotNil)
+	deliveryErr := err.(SendErrors)[0].(*DeliveryError)
+	c.Assert(deliveryErr.Spooled, Equals, true)
+
+	sent := receivedPoints(c, listener)
+	c.Assert(deliveryErr.BatchSize, Equals, 150-sent)
+	stats := ep.Stats()
+	c.Assert(stats.Flushed, Equals, uint64(sent))
+	c.Assert(stats.Failed["udp"], Equals, uint64(150-sent))
+
+	spooled := 0
+	_, err = ep.spool.replay(func(postType PostType, operation *WriteOperation) error {
+		spooled += operation.pointCount()
+		return nil
+	}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(spooled, Equals, 150-sent)
+}
@@ -0,0 +1,27 @@
+package errplane
+
+import (
+	"fmt"
+)
+
+// DeliveryError is passed to the ErrorHandler (and returned by Flush) when
+// a batch couldn't be delivered.
+type DeliveryError struct {
+	// the type of the transport, either http or udp
+	Transport string
+	// the number of points in the batch
+	BatchSize int
+	// whether sending the batch again later could succeed
+	Retryable bool
+	// whether the batch was saved in the spool to be replayed later
+	Spooled bool
+	Err     error
+}
+
+func (self *DeliveryError) Error() string {
+	return fmt.Sprintf("Error while posting %d points to Errplane using %s. Error: %s", self.BatchSize, self.Transport, self.Err)
+}
+
+func (self *DeliveryError) Unwrap() error {
+	return self.Err
+}
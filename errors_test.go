@@ -0,0 +1,89 @@
+package errplane
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	. "launchpad.net/gocheck"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ErrorsSuite struct{}
+
+var _ = Suite(&ErrorsSuite{})
+
+type errorRecorder struct {
+	lock   sync.Mutex
+	errors []error
+}
+
+func (self *errorRecorder) handle(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.errors = append(self.errors, err)
+}
+
+func (s *ErrorsSuite) TestErrorHandlerReceivesDeliveryErrors(c *C) {
+	recorder := &errorRecorder{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(&recordingTransport{err: errCollectorDown}),
+		WithErrorHandler(recorder.handle),
+	)...)
+	c.Assert(err, IsNil)
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Report("other_metric", 1, time.Now(), "", nil), IsNil)
+	ep.Close()
+
+	c.Assert(recorder.errors, HasLen, 1)
+	deliveryErr, ok := recorder.errors[0].(*DeliveryError)
+	c.Assert(ok, Equals, true)
+	c.Assert(deliveryErr.Transport, Equals, "http")
+	c.Assert(deliveryErr.BatchSize, Equals, 2)
+	c.Assert(deliveryErr.Retryable, Equals, true)
+	c.Assert(deliveryErr.Spooled, Equals, false)
+	c.Assert(errors.Is(deliveryErr, errCollectorDown), Equals, true)
+}
+
+func (s *ErrorsSuite) TestUnknownOperationDoesNotPanic(c *C) {
+	recorder := &errorRecorder{}
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithUdpTransport(transport),
+		WithErrorHandler(recorder.handle),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.sendUdpPayload("x", "some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), NotNil)
+
+	c.Assert(recorder.errors, HasLen, 1)
+	c.Assert(recorder.errors[0].(*DeliveryError).Retryable, Equals, false)
+	c.Assert(transport.sent(), HasLen, 1)
+}
+
+func (s *ErrorsSuite) TestLogger(c *C) {
+	buffer := &bytes.Buffer{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(&recordingTransport{err: errCollectorDown}),
+		WithLogger(NewStdLogger(log.New(buffer, "", 0))),
+	)...)
+	c.Assert(err, IsNil)
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	ep.Close()
+
+	c.Assert(strings.HasPrefix(buffer.String(), "ERROR Error while posting 1 points to Errplane using http"), Equals, true)
+}
+
+func (s *ErrorsSuite) TestNilLoggerRestoresTheDefault(c *C) {
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	ep.SetLogger(nil)
+	c.Assert(ep.logger, Equals, defaultLogger)
+}
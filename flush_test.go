@@ -0,0 +1,69 @@
+package errplane
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type FlushSuite struct{}
+
+var _ = Suite(&FlushSuite{})
+
+func (s *FlushSuite) TestFlushDeliversQueuedPoints(c *C) {
+	httpTransport := &recordingTransport{}
+	udpTransport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	ep.SetHttpTransport(httpTransport)
+	ep.SetUdpTransport(udpTransport)
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Histogram("some_histogram", 1, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	c.Assert(httpTransport.sent(), HasLen, 1)
+	c.Assert(pointsByName(udpTransport.sent(), "r")["some_histogram.p50"], HasLen, 1)
+
+	// the client is still usable
+	c.Assert(ep.Report("some_metric", 2, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	c.Assert(httpTransport.sent(), HasLen, 2)
+}
+
+func (s *FlushSuite) TestFlushReturnsSendErrors(c *C) {
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(&recordingTransport{err: errCollectorDown}),
+		WithUdpTransport(&recordingTransport{err: errCollectorDown}),
+		WithErrorHandler(func(error) {}),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	err = ep.Flush(context.Background())
+	c.Assert(err, FitsTypeOf, SendErrors{})
+	c.Assert(err.(SendErrors), HasLen, 2)
+}
+
+func (s *FlushSuite) TestFlushDeadline(c *C) {
+	release := make(chan bool)
+	defer close(release)
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(TransportFunc(func(operation *WriteOperation) error {
+		<-release
+		return nil
+	}))
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(ep.Flush(ctx), Equals, context.DeadlineExceeded)
+}
+
+func (s *FlushSuite) TestFlushAfterClose(c *C) {
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.Close()
+	c.Assert(ep.Flush(context.Background()), Equals, ErrClosed)
+}
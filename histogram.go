@@ -0,0 +1,120 @@
+package errplane
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var DEFAULT_PERCENTILES = []float64{0.5, 0.9, 0.99, 0.999}
+
+type histogramSeries struct {
+	metric     string
+	context    string
+	dimensions Dimensions
+	sketch     *Sketch
+}
+
+// histograms keeps a sketch per metric, context and set of dimensions, the
+// configured percentiles are sent once per flush interval as derived
+// metrics, e.g. <metric>.p50 and <metric>.p999
+type histograms struct {
+	lock        sync.Mutex
+	percentiles []float64
+	series      map[string]*histogramSeries
+}
+
+func newHistograms() *histograms {
+	return &histograms{
+		percentiles: DEFAULT_PERCENTILES,
+		series:      make(map[string]*histogramSeries),
+	}
+}
+
+func validatePercentiles(percentiles []float64) error {
+	for _, percentile := range percentiles {
+		if percentile < 0 || percentile > 1 {
+			return fmt.Errorf("Percentiles must be between 0 and 1, got %v", percentile)
+		}
+	}
+	return nil
+}
+
+func (self *histograms) setPercentiles(percentiles []float64) error {
+	if err := validatePercentiles(percentiles); err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.percentiles = append([]float64{}, percentiles...)
+	return nil
+}
+
+func (self *histograms) add(metric string, point *JsonPoint) {
+	key := seriesKey(metric, point.Context, point.Dimensions)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	series := self.series[key]
+	if series == nil {
+		var dimensions Dimensions
+		if point.Dimensions != nil {
+			dimensions = make(Dimensions, len(point.Dimensions))
+			for key, value := range point.Dimensions {
+				dimensions[key] = value
+			}
+		}
+		sketch, _ := NewSketch(DEFAULT_SKETCH_ACCURACY)
+		series = &histogramSeries{metric, point.Context, dimensions, sketch}
+		self.series[key] = series
+	}
+	series.sketch.Add(point.Value)
+}
+
+// The number of points the next flush will return
+func (self *histograms) pending() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.series) * len(self.percentiles)
+}
+
+// Return the percentiles of every histogram and start a new interval
+func (self *histograms) flush() []*ErrplanePost {
+	self.lock.Lock()
+	all, percentiles := self.series, self.percentiles
+	self.series = make(map[string]*histogramSeries)
+	self.lock.Unlock()
+
+	posts := make([]*ErrplanePost, 0, len(all)*len(percentiles))
+	for _, series := range all {
+		if series.sketch.Count() == 0 {
+			continue
+		}
+		for _, percentile := range percentiles {
+			point := &JsonPoint{
+				Value:      series.sketch.Quantile(percentile),
+				Context:    series.context,
+				Dimensions: series.dimensions,
+			}
+			posts = append(posts, aggregatedPost("r", series.metric+"."+percentileSuffix(percentile), point))
+		}
+	}
+	return posts
+}
+
+// 0.5 => p50, 0.99 => p99, 0.999 => p999
+func percentileSuffix(percentile float64) string {
+	if percentile >= 1 {
+		return "p100"
+	}
+	digits := strings.TrimPrefix(strconv.FormatFloat(percentile, 'f', -1, 64), "0.")
+	if digits == "0" {
+		return "p0"
+	}
+	for len(digits) < 2 {
+		digits += "0"
+	}
+	return "p" + digits
+}
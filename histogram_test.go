@@ -0,0 +1,70 @@
+package errplane
+
+import (
+	. "launchpad.net/gocheck"
+	"math"
+)
+
+type HistogramSuite struct{}
+
+var _ = Suite(&HistogramSuite{})
+
+func (s *HistogramSuite) TestSendsPercentiles(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(transport)
+
+	for i := 1; i <= 1000; i++ {
+		c.Assert(ep.Histogram("latency", float64(i), "", Dimensions{"foo": "bar"}), IsNil)
+	}
+	ep.Close()
+
+	reports := pointsByName(transport.sent(), "r")
+	c.Assert(reports, HasLen, 4)
+	expected := map[string]float64{"latency.p50": 500, "latency.p90": 900, "latency.p99": 990, "latency.p999": 999}
+	for name, value := range expected {
+		c.Assert(reports[name], HasLen, 1)
+		c.Assert(math.Abs(reports[name][0].Value-value) <= value*DEFAULT_SKETCH_ACCURACY, Equals, true)
+		c.Assert(reports[name][0].Dimensions, DeepEquals, map[string]string{"foo": "bar"})
+	}
+}
+
+func (s *HistogramSuite) TestSetPercentiles(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(transport)
+	c.Assert(ep.SetPercentiles(1.5), NotNil)
+	c.Assert(ep.SetPercentiles(0.75, 0.95), IsNil)
+
+	c.Assert(ep.Histogram("latency", 10, "", nil), IsNil)
+	ep.Close()
+
+	reports := pointsByName(transport.sent(), "r")
+	c.Assert(reports, HasLen, 2)
+	c.Assert(reports["latency.p75"], HasLen, 1)
+	c.Assert(reports["latency.p95"], HasLen, 1)
+}
+
+func (s *HistogramSuite) TestPercentileSuffix(c *C) {
+	for percentile, suffix := range map[float64]string{0: "p0", 0.5: "p50", 0.9: "p90", 0.95: "p95", 0.99: "p99", 0.999: "p999", 1: "p100"} {
+		c.Assert(percentileSuffix(percentile), Equals, suffix)
+	}
+}
+
+func (s *HistogramSuite) TestRejectsNonFiniteValues(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(transport)
+
+	c.Assert(ep.Histogram("latency", math.NaN(), "", nil), NotNil)
+	c.Assert(ep.Histogram("latency", math.Inf(1), "", nil), NotNil)
+	c.Assert(ep.Histogram("latency", math.Inf(-1), "", nil), NotNil)
+	c.Assert(ep.Histogram("latency", 10, "", nil), IsNil)
+	ep.Close()
+
+	reports := pointsByName(transport.sent(), "r")
+	c.Assert(reports, HasLen, 4)
+	for _, points := range reports {
+		c.Assert(math.IsNaN(points[0].Value), Equals, false)
+	}
+}
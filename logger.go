@@ -0,0 +1,32 @@
+package errplane
+
+import (
+	"log"
+	"os"
+)
+
+// Logger receives the warnings and errors of the client. Errors are only
+// logged if there's no ErrorHandler.
+type Logger interface {
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type stdLogger struct {
+	logger *log.Logger
+}
+
+// Adapt a logger from the log package
+func NewStdLogger(logger *log.Logger) Logger {
+	return &stdLogger{logger}
+}
+
+func (self *stdLogger) Warnf(format string, args ...interface{}) {
+	self.logger.Printf("WARN "+format, args...)
+}
+
+func (self *stdLogger) Errorf(format string, args ...interface{}) {
+	self.logger.Printf("ERROR "+format, args...)
+}
+
+var defaultLogger = NewStdLogger(log.New(os.Stderr, "errplane: ", log.LstdFlags))
@@ -0,0 +1,216 @@
+package errplane
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MultiPolicy decides how a MultiTransport uses its targets
+type MultiPolicy int
+
+const (
+	// Send to the first healthy target, a target that fails with a
+	// retryable error is skipped until its backoff expires
+	MultiFailover MultiPolicy = iota
+	// Send every operation to all targets
+	MultiFanOut
+)
+
+func validateMultiPolicy(policy MultiPolicy, targets int) error {
+	if policy != MultiFailover && policy != MultiFanOut {
+		return fmt.Errorf("Unknown multi transport policy %d", policy)
+	}
+	if targets == 0 {
+		return fmt.Errorf("Multi transport needs at least one target")
+	}
+	return nil
+}
+
+// How long a failed target is skipped by MultiFailover, the backoff grows
+// with every consecutive failure
+var DEFAULT_FAILOVER_POLICY = RetryPolicy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+// MultiTransport sends operations to several transports, either to the
+// first healthy one or to all of them, see MultiPolicy.
+type MultiTransport struct {
+	policy     MultiPolicy
+	transports []Transport
+	backoff    RetryPolicy
+	now        func() time.Time
+
+	lock     sync.Mutex
+	failures []int
+	retryAt  []time.Time
+}
+
+func NewMultiTransport(policy MultiPolicy, transports ...Transport) (*MultiTransport, error) {
+	if err := validateMultiPolicy(policy, len(transports)); err != nil {
+		return nil, err
+	}
+	return &MultiTransport{
+		policy:     policy,
+		transports: transports,
+		backoff:    DEFAULT_FAILOVER_POLICY,
+		now:        time.Now,
+		failures:   make([]int, len(transports)),
+		retryAt:    make([]time.Time, len(transports)),
+	}, nil
+}
+
+// How long a failed target is skipped by MultiFailover,
+// DEFAULT_FAILOVER_POLICY by default. MaxRetries is ignored.
+func (self *MultiTransport) SetFailoverBackoff(policy RetryPolicy) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.backoff = policy
+}
+
+func (self *MultiTransport) Send(data *WriteOperation) error {
+	if self.policy == MultiFanOut {
+		return self.fanOut(data)
+	}
+	return self.failover(data)
+}
+
+// Try the healthy targets in order, then the unhealthy ones if all healthy
+// targets failed. Non retryable errors are returned right away since
+// another target wouldn't accept the operation either. After a
+// *PartialSendError only the remaining points go to the next target.
+func (self *MultiTransport) failover(data *WriteOperation) error {
+	healthy, unhealthy := self.targets()
+	var err error
+	partial := false
+	for _, i := range append(healthy, unhealthy...) {
+		if err = self.transports[i].Send(data); err == nil {
+			self.succeeded(i)
+			return nil
+		}
+		if !isRetryable(err) {
+			break
+		}
+		self.failed(i)
+		var partialErr *PartialSendError
+		if errors.As(err, &partialErr) {
+			data, partial = partialErr.Remaining, true
+		}
+	}
+
+	// report the points that are still unsent, unless the error already
+	// says which points failed
+	var partialErr *PartialSendError
+	var tooLarge *DatagramTooLargeError
+	if partial && !errors.As(err, &partialErr) && !errors.As(err, &tooLarge) {
+		return &PartialSendError{Remaining: data, Err: err}
+	}
+	return err
+}
+
+func (self *MultiTransport) targets() ([]int, []int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.now()
+	healthy, unhealthy := []int{}, []int{}
+	for i := range self.transports {
+		if self.retryAt[i].After(now) {
+			unhealthy = append(unhealthy, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return healthy, unhealthy
+}
+
+func (self *MultiTransport) succeeded(target int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failures[target] = 0
+	self.retryAt[target] = time.Time{}
+}
+
+func (self *MultiTransport) failed(target int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.retryAt[target] = self.now().Add(self.backoff.backoff(self.failures[target]))
+	self.failures[target]++
+}
+
+// Healthy reports, for every target, whether MultiFailover currently sends
+// to it.
+func (self *MultiTransport) Healthy() []bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.now()
+	healthy := make([]bool, len(self.transports))
+	for i := range healthy {
+		healthy[i] = !self.retryAt[i].After(now)
+	}
+	return healthy
+}
+
+func (self *MultiTransport) fanOut(data *WriteOperation) error {
+	errs := make([]error, len(self.transports))
+	var wait sync.WaitGroup
+	for i, transport := range self.transports {
+		wait.Add(1)
+		go func(i int, transport Transport) {
+			defer wait.Done()
+			errs[i] = transport.Send(data)
+		}(i, transport)
+	}
+	wait.Wait()
+
+	fanOutErr := &FanOutError{Targets: len(self.transports)}
+	for _, err := range errs {
+		if err != nil {
+			fanOutErr.Errors = append(fanOutErr.Errors, err)
+		}
+	}
+	if len(fanOutErr.Errors) == 0 {
+		return nil
+	}
+	return fanOutErr
+}
+
+// Close the transports created by this package
+func (self *MultiTransport) Close() error {
+	for _, transport := range self.transports {
+		closeBuiltinTransport(transport)
+	}
+	return nil
+}
+
+// FanOutError is returned by a MultiFanOut transport when some of its
+// targets failed.
+type FanOutError struct {
+	Targets int
+	Errors  []error
+}
+
+func (self *FanOutError) Error() string {
+	messages := make([]string, 0, len(self.Errors))
+	for _, err := range self.Errors {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("Failed to send to %d of %d targets: %s", len(self.Errors), self.Targets, strings.Join(messages, "; "))
+}
+
+// Retrying is only safe if no target received the operation or a part of
+// it, otherwise the targets that succeeded would get it twice.
+func (self *FanOutError) Retryable() bool {
+	if len(self.Errors) < self.Targets {
+		return false
+	}
+	for _, err := range self.Errors {
+		var partial *PartialSendError
+		if errors.As(err, &partial) || !isRetryable(err) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package errplane
+
+import (
+	"context"
+	"errors"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+type MultiSuite struct{}
+
+var _ = Suite(&MultiSuite{})
+
+func (s *MultiSuite) TestFailsOverToTheNextHealthyTarget(c *C) {
+	primary := &recordingTransport{err: errCollectorDown}
+	secondary := &recordingTransport{}
+	multi, err := NewMultiTransport(MultiFailover, primary, secondary)
+	c.Assert(err, IsNil)
+	now := time.Now()
+	multi.now = func() time.Time { return now }
+
+	c.Assert(multi.Send(&WriteOperation{}), IsNil)
+	c.Assert(primary.sent(), HasLen, 1)
+	c.Assert(secondary.sent(), HasLen, 1)
+	c.Assert(multi.Healthy(), DeepEquals, []bool{false, true})
+
+	// the primary is skipped until its backoff expires
+	c.Assert(multi.Send(&WriteOperation{}), IsNil)
+	c.Assert(primary.sent(), HasLen, 1)
+	c.Assert(secondary.sent(), HasLen, 2)
+
+	primary.err = nil
+	now = now.Add(DEFAULT_FAILOVER_POLICY.InitialBackoff)
+	c.Assert(multi.Send(&WriteOperation{}), IsNil)
+	c.Assert(primary.sent(), HasLen, 2)
+	c.Assert(secondary.sent(), HasLen, 2)
+	c.Assert(multi.Healthy(), DeepEquals, []bool{true, true})
+}
+
+func (s *MultiSuite) TestTriesUnhealthyTargetsLast(c *C) {
+	primary := &recordingTransport{err: errCollectorDown}
+	secondary := &recordingTransport{err: errCollectorDown}
+	multi, err := NewMultiTransport(MultiFailover, primary, secondary)
+	c.Assert(err, IsNil)
+
+	c.Assert(multi.Send(&WriteOperation{}), Equals, errCollectorDown)
+	c.Assert(multi.Healthy(), DeepEquals, []bool{false, false})
+
+	secondary.err = nil
+	c.Assert(multi.Send(&WriteOperation{}), IsNil)
+	c.Assert(secondary.sent(), HasLen, 2)
+	c.Assert(multi.Healthy(), DeepEquals, []bool{false, true})
+}
+
+func (s *MultiSuite) TestDoesNotFailOverOnPermanentErrors(c *C) {
+	primary := &recordingTransport{err: errors.New("bad request")}
+	secondary := &recordingTransport{}
+	multi, err := NewMultiTransport(MultiFailover, primary, secondary)
+	c.Assert(err, IsNil)
+
+	c.Assert(multi.Send(&WriteOperation{}), ErrorMatches, "bad request")
+	c.Assert(secondary.sent(), HasLen, 0)
+	c.Assert(multi.Healthy(), DeepEquals, []bool{true, true})
+}
+
+func (s *MultiSuite) TestFansOutToAllTargets(c *C) {
+	legacy := &recordingTransport{}
+	current := &recordingTransport{}
+	multi, err := NewMultiTransport(MultiFanOut, legacy, current)
+	c.Assert(err, IsNil)
+
+	c.Assert(multi.Send(&WriteOperation{}), IsNil)
+	c.Assert(legacy.sent(), HasLen, 1)
+	c.Assert(current.sent(), HasLen, 1)
+
+	// a partial failure isn't retried, the other target already has the points
+	legacy.err = errCollectorDown
+	err = multi.Send(&WriteOperation{})
+	c.Assert(err, ErrorMatches, "Failed to send to 1 of 2 targets: .*")
+	c.Assert(isRetryable(err), Equals, false)
+
+	current.err = errCollectorDown
+	c.Assert(isRetryable(multi.Send(&WriteOperation{})), Equals, true)
+}
+
+func (s *MultiSuite) TestSetHttpHosts(c *C) {
+	requests := make(chan string, 10)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			requests <- name
+			writer.WriteHeader(201)
+		}))
+	}
+	legacy, current := newServer("legacy"), newServer("current")
+	defer legacy.Close()
+	defer current.Close()
+
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpScheme("http"), WithHttpHosts(MultiFanOut,
+		strings.TrimPrefix(legacy.URL, "http://"), strings.TrimPrefix(current.URL, "http://")))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	received := []string{<-requests, <-requests}
+	c.Assert(received, HasLen, 2)
+	c.Assert(received[0] != received[1], Equals, true)
+
+	// configuration changes keep both hosts
+	ep.SetRetryPolicy(RetryPolicy{})
+	c.Assert(transportTargets(ep.httpTransport), HasLen, 2)
+}
+
+func (s *MultiSuite) TestValidatesTargets(c *C) {
+	_, err := NewMultiTransport(MultiFailover)
+	c.Assert(err, ErrorMatches, ".*at least one target.*")
+	_, err = NewMultiTransport(MultiPolicy(42), &recordingTransport{})
+	c.Assert(err, ErrorMatches, "Unknown multi transport policy 42")
+
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	c.Assert(ep.SetHttpHosts(MultiFailover), NotNil)
+	c.Assert(ep.SetUdpAddrs(MultiFanOut, "localhost:8126", "no-port"), NotNil)
+	c.Assert(ep.SetUdpAddrs(MultiFanOut, "localhost:8126", "localhost:8127"), IsNil)
+	c.Assert(transportTargets(ep.udpTransport), HasLen, 2)
+}
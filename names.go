@@ -0,0 +1,122 @@
+package errplane
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NamePolicy describes valid metric names. Names are made of ascii
+// letters, digits, '.', '_' and '-', and of unicode letters and digits if
+// AllowUnicode is set. Segments are the parts of a name between dots.
+// MaxLength counts bytes, MaxSegmentLength characters, zero means no limit.
+type NamePolicy struct {
+	AllowUnicode     bool
+	MaxLength        int
+	MaxSegmentLength int
+	// names can't start with these prefixes, e.g. "errplane." to keep them
+	// for the client's own metrics, which are exempt
+	ReservedPrefixes []string
+}
+
+var DEFAULT_NAME_POLICY = NamePolicy{MaxLength: 255}
+
+// NameError describes why a metric name is invalid, Position is the index
+// of the offending character (not byte) in Name.
+type NameError struct {
+	Name     string
+	Position int
+	Reason   string
+}
+
+func (self *NameError) Error() string {
+	return fmt.Sprintf("Invalid metric name %s at position %d: %s", self.Name, self.Position, self.Reason)
+}
+
+// Check the name against DEFAULT_NAME_POLICY, returns a *NameError if the
+// name is invalid.
+func ValidateMetricName(name string) error {
+	return DEFAULT_NAME_POLICY.Validate(name)
+}
+
+func (self NamePolicy) validCharacter(ch rune) bool {
+	switch {
+	case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		return true
+	case ch == '.' || ch == '_' || ch == '-':
+		return true
+	case self.AllowUnicode && ch != utf8.RuneError:
+		return unicode.IsLetter(ch) || unicode.IsDigit(ch)
+	}
+	return false
+}
+
+// Check the name against the policy, returns a *NameError if the name is
+// invalid.
+func (self NamePolicy) Validate(name string) error {
+	for _, prefix := range self.ReservedPrefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return &NameError{Name: name, Position: 0, Reason: fmt.Sprintf("the prefix %s is reserved", prefix)}
+		}
+	}
+
+	position, segmentLength := 0, 0
+	for index, ch := range name {
+		if !self.validCharacter(ch) {
+			return &NameError{Name: name, Position: position, Reason: fmt.Sprintf("invalid character %q", ch)}
+		}
+		if self.MaxLength > 0 && index+utf8.RuneLen(ch) > self.MaxLength {
+			return &NameError{Name: name, Position: position, Reason: fmt.Sprintf("names must be at most %d bytes", self.MaxLength)}
+		}
+		if ch == '.' {
+			segmentLength = 0
+		} else if segmentLength++; self.MaxSegmentLength > 0 && segmentLength > self.MaxSegmentLength {
+			return &NameError{Name: name, Position: position, Reason: fmt.Sprintf("segments must be at most %d characters", self.MaxSegmentLength)}
+		}
+		position++
+	}
+	return nil
+}
+
+// Make the name valid for the policy: invalid characters are replaced with
+// underscores, reserved prefixes are removed and long segments and names
+// are truncated.
+func (self NamePolicy) Sanitize(name string) string {
+	sanitized := []rune(name)
+	for i, ch := range sanitized {
+		if !self.validCharacter(ch) {
+			sanitized[i] = '_'
+		}
+	}
+	name = string(sanitized)
+
+	if self.MaxSegmentLength > 0 {
+		segments := strings.Split(name, ".")
+		for i, segment := range segments {
+			if runes := []rune(segment); len(runes) > self.MaxSegmentLength {
+				segments[i] = string(runes[:self.MaxSegmentLength])
+			}
+		}
+		name = strings.Join(segments, ".")
+	}
+
+	// removing a prefix can reveal another one
+	for stripped := true; stripped; {
+		stripped = false
+		for _, prefix := range self.ReservedPrefixes {
+			if prefix != "" && strings.HasPrefix(name, prefix) {
+				name = strings.TrimPrefix(name, prefix)
+				stripped = true
+			}
+		}
+	}
+	return truncate(name, self.MaxLength)
+}
+
+func validateNamePolicy(policy NamePolicy) error {
+	if policy.MaxLength < 0 || policy.MaxSegmentLength < 0 {
+		return fmt.Errorf("Name policy cannot have negative lengths")
+	}
+	return nil
+}
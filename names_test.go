@@ -0,0 +1,92 @@
+package errplane
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type NamesSuite struct{}
+
+var _ = Suite(&NamesSuite{})
+
+func nameError(c *C, err error) *NameError {
+	nameErr, ok := err.(*NameError)
+	c.Assert(ok, Equals, true, Commentf("%v", err))
+	return nameErr
+}
+
+func (s *NamesSuite) TestValidateMetricName(c *C) {
+	for _, name := range []string{"requests", "api.requests-per_second", "a.b.c", ""} {
+		c.Assert(ValidateMetricName(name), IsNil, Commentf("%s", name))
+		c.Assert(METRIC_REGEX.MatchString(name), Equals, true)
+	}
+
+	err := nameError(c, ValidateMetricName("invalid/metric/name"))
+	c.Assert(err.Position, Equals, 7)
+	c.Assert(err, ErrorMatches, `Invalid metric name invalid/metric/name at position 7: invalid character '/'`)
+
+	err = nameError(c, ValidateMetricName(strings.Repeat("a", 256)))
+	c.Assert(err.Position, Equals, 255)
+}
+
+func (s *NamesSuite) TestUnicodeNames(c *C) {
+	err := nameError(c, ValidateMetricName("café.latte"))
+	c.Assert(err.Position, Equals, 3)
+
+	policy := NamePolicy{AllowUnicode: true}
+	c.Assert(policy.Validate("café.latte"), IsNil)
+	c.Assert(policy.Validate("請求.数"), IsNil)
+	c.Assert(nameError(c, policy.Validate("請求 数")).Position, Equals, 2)
+}
+
+func (s *NamesSuite) TestSegmentsAndReservedPrefixes(c *C) {
+	policy := NamePolicy{MaxSegmentLength: 3, ReservedPrefixes: []string{"errplane."}}
+	c.Assert(policy.Validate("abc.def"), IsNil)
+	c.Assert(nameError(c, policy.Validate("abc.defg")).Position, Equals, 7)
+
+	err := nameError(c, policy.Validate("errplane.cpu"))
+	c.Assert(err.Position, Equals, 0)
+	c.Assert(err.Reason, Matches, ".*reserved.*")
+}
+
+func (s *NamesSuite) TestSanitize(c *C) {
+	policy := NamePolicy{AllowUnicode: true, MaxLength: 12, MaxSegmentLength: 4, ReservedPrefixes: []string{"errplane.", "app."}}
+	c.Assert(policy.Sanitize("café latte"), Equals, "café")
+	// names are truncated to MaxLength bytes
+	c.Assert(policy.Sanitize("請求.数/秒"), Equals, "請求.数_")
+	c.Assert(policy.Sanitize("app.app.cpu"), Equals, "cpu")
+	c.Assert(policy.Sanitize("a.bb.cc.dd.ee"), Equals, "a.bb.cc.dd.e")
+	for _, name := range []string{"café latte", "請求.数/秒", "app.app.cpu", "errplane.cpu", "a.bb.cc.dd.ee", "abcdefgh.ijklmnop"} {
+		c.Assert(policy.Validate(policy.Sanitize(name)), IsNil, Commentf("%s", name))
+	}
+}
+
+func (s *NamesSuite) TestClientStatsIgnoreReservedPrefixes(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport),
+		WithNamePolicy(NamePolicy{ReservedPrefixes: []string{"errplane."}}))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("errplane.cpu", 1, time.Now(), "", nil), NotNil)
+	ep.reportClientStats("", nil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	c.Assert(pointsByName(transport.sent(), "")["errplane.client.points.enqueued"], HasLen, 1)
+}
+
+func (s *NamesSuite) TestSetNamePolicy(c *C) {
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	ep.SetHttpTransport(&recordingTransport{})
+	c.Assert(ep.Report("some-metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Report("café", 1, time.Now(), "", nil), NotNil)
+
+	c.Assert(ep.SetNamePolicy(NamePolicy{AllowUnicode: true, MaxLength: 255}), IsNil)
+	c.Assert(ep.Report("café", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.SetNamePolicy(NamePolicy{MaxSegmentLength: -1}), NotNil)
+
+	_, err := NewWithOptions(append(requiredOptions, WithNamePolicy(NamePolicy{MaxLength: -1}))...)
+	c.Assert(err, NotNil)
+}
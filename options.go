@@ -0,0 +1,549 @@
+package errplane
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Option configures a client created with NewWithOptions
+type Option func(*config) error
+
+// ErrorHandler is called with every error that happens while delivering
+// points in the background, instead of logging it. Delivery failures are
+// passed as *DeliveryError.
+type ErrorHandler func(error)
+
+// Clock is the source of the current time used for heartbeats, runtime
+// stats and timers.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (self realClock) Now() time.Time {
+	return time.Now()
+}
+
+const (
+	DEFAULT_TIMEOUT        = 2 * time.Second
+	DEFAULT_FLUSH_INTERVAL = 1 * time.Second
+	DEFAULT_BATCH_SIZE     = 100
+)
+
+type config struct {
+	app             string
+	environment     string
+	apiKey          string
+	proto           string
+	httpHosts       []string
+	httpPolicy      MultiPolicy
+	udpAddrs        []string
+	udpPolicy       MultiPolicy
+	tcpAddr         string
+	tcpTlsConfig    *tls.Config
+	proxy           *url.URL
+	tlsConfig       *tls.Config
+	streamTlsConfig *tls.Config
+	timeout         time.Duration
+	flushInterval   time.Duration
+	batchSize       int
+	queueSize       int
+	overflowPolicy  OverflowPolicy
+	overflowTimeout time.Duration
+	retryPolicy     RetryPolicy
+	breakerPolicy   BreakerPolicy
+	rateLimits      map[PostType]RateLimit
+	compressor      Compressor
+	errorHandler    ErrorHandler
+	logger          Logger
+	clock           Clock
+	httpClient      *http.Client
+	httpTransport   Transport
+	udpTransport    Transport
+	spool           *SpoolConfig
+	preAggregation  bool
+	percentiles     []float64
+	maxDatagramSize int
+
+	compressionThreshold int
+	cardinalityLimit     *CardinalityLimit
+	dimensionRules       *DimensionRules
+	namePolicy           NamePolicy
+
+	// the options that were given, to detect conflicting ones
+	given map[string]bool
+}
+
+// options that are ignored, or override each other, when used together
+var conflictingOptions = []struct {
+	option string
+	others []string
+}{
+	{"WithHttpClient", []string{"WithProxy", "WithTlsConfig", "WithTlsOptions", "WithTimeout"}},
+	{"WithHttpTransport", []string{"WithHttpHost", "WithHttpHosts"}},
+	{"WithUdpTransport", []string{"WithUdpAddr", "WithUdpAddrs", "WithTcpAddr"}},
+	{"WithTcpAddr", []string{"WithUdpAddr", "WithUdpAddrs"}},
+	{"WithTlsConfig", []string{"WithTlsOptions"}},
+}
+
+func defaultConfig(proto, app, environment, apiKey string) *config {
+	return &config{
+		app:           app,
+		environment:   environment,
+		apiKey:        apiKey,
+		proto:         proto,
+		httpHosts:     []string{DEFAULT_HTTP_HOST},
+		udpAddrs:      []string{DEFAULT_UDP_ADDR},
+		timeout:       DEFAULT_TIMEOUT,
+		flushInterval: DEFAULT_FLUSH_INTERVAL,
+		batchSize:     DEFAULT_BATCH_SIZE,
+		queueSize:     DEFAULT_QUEUE_SIZE,
+		retryPolicy:   DEFAULT_RETRY_POLICY,
+		breakerPolicy: DEFAULT_BREAKER_POLICY,
+		logger:        defaultLogger,
+		clock:         realClock{},
+		namePolicy:    DEFAULT_NAME_POLICY,
+		percentiles:   DEFAULT_PERCENTILES,
+
+		maxDatagramSize: DEFAULT_MAX_DATAGRAM_SIZE,
+		given:           make(map[string]bool),
+	}
+}
+
+// remember that the option was given
+func (self *config) mark(option string) {
+	self.given[option] = true
+}
+
+func (self *config) checkConflicts() error {
+	for _, conflict := range conflictingOptions {
+		if !self.given[conflict.option] {
+			continue
+		}
+		for _, other := range conflict.others {
+			if self.given[other] {
+				return fmt.Errorf("%s cannot be combined with %s", conflict.option, other)
+			}
+		}
+	}
+	return nil
+}
+
+// Create a client configured with the given options. Unlike New, all
+// settings are validated up front and the first invalid one is returned as
+// an error, as are options that can't be used together, e.g. WithHttpClient
+// and WithProxy. WithApp and WithApiKey are required.
+//
+//	ep, err := errplane.NewWithOptions(
+//		errplane.WithApp("app4you2love", "production"),
+//		errplane.WithApiKey("some_key"),
+//		errplane.WithFlushInterval(5*time.Second),
+//	)
+func NewWithOptions(options ...Option) (*Errplane, error) {
+	config := defaultConfig("https", "", "", "")
+	for _, option := range options {
+		if err := option(config); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.checkConflicts(); err != nil {
+		return nil, err
+	}
+	if config.app == "" {
+		return nil, fmt.Errorf("Application key cannot be empty")
+	}
+	if config.apiKey == "" {
+		return nil, fmt.Errorf("Api key cannot be empty")
+	}
+	return newClient(config)
+}
+
+// The application key and environment from the Settings/Applications page
+func WithApp(app, environment string) Option {
+	return func(config *config) error {
+		config.app = app
+		config.environment = environment
+		return nil
+	}
+}
+
+// The api key from the Settings/Organizations page
+func WithApiKey(apiKey string) Option {
+	return func(config *config) error {
+		config.apiKey = apiKey
+		return nil
+	}
+}
+
+// Either https (the default) or http
+func WithHttpScheme(scheme string) Option {
+	return func(config *config) error {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("Unsupported scheme %s", scheme)
+		}
+		config.proto = scheme
+		return nil
+	}
+}
+
+// The host (and optional port) of the http api, DEFAULT_HTTP_HOST by default
+func WithHttpHost(host string) Option {
+	return withHttpHosts("WithHttpHost", MultiFailover, host)
+}
+
+// See SetHttpHosts
+func WithHttpHosts(policy MultiPolicy, hosts ...string) Option {
+	return withHttpHosts("WithHttpHosts", policy, hosts...)
+}
+
+func withHttpHosts(option string, policy MultiPolicy, hosts ...string) Option {
+	return func(config *config) error {
+		if err := validateMultiPolicy(policy, len(hosts)); err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			if host == "" {
+				return fmt.Errorf("Http host cannot be empty")
+			}
+		}
+		config.httpHosts = hosts
+		config.httpPolicy = policy
+		config.mark(option)
+		return nil
+	}
+}
+
+// The address used for udp points, DEFAULT_UDP_ADDR by default, see SetUdpAddr
+func WithUdpAddr(addr string) Option {
+	return withUdpAddrs("WithUdpAddr", MultiFailover, addr)
+}
+
+// See SetUdpAddrs
+func WithUdpAddrs(policy MultiPolicy, addrs ...string) Option {
+	return withUdpAddrs("WithUdpAddrs", policy, addrs...)
+}
+
+func withUdpAddrs(option string, policy MultiPolicy, addrs ...string) Option {
+	return func(config *config) error {
+		if err := validateMultiPolicy(policy, len(addrs)); err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			if _, _, err := parseUdpAddr(addr); err != nil {
+				return err
+			}
+		}
+		config.udpAddrs = addrs
+		config.udpPolicy = policy
+		config.mark(option)
+		return nil
+	}
+}
+
+// See SetTcpAddr
+func WithTcpAddr(addr string, tlsConfig *tls.Config) Option {
+	return func(config *config) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Invalid tcp address %s. Error: %s", addr, err)
+		}
+		config.tcpAddr = addr
+		config.tcpTlsConfig = tlsConfig
+		config.mark("WithTcpAddr")
+		return nil
+	}
+}
+
+// See SetMaxDatagramSize
+func WithMaxDatagramSize(size int) Option {
+	return func(config *config) error {
+		if size < 0 {
+			return fmt.Errorf("Maximum datagram size cannot be negative")
+		}
+		config.maxDatagramSize = size
+		return nil
+	}
+}
+
+// The url of the proxy used for http requests
+func WithProxy(proxy string) Option {
+	return func(config *config) error {
+		proxyUrl, err := url.Parse(proxy)
+		if err != nil {
+			return err
+		}
+		if proxyUrl.Scheme == "" || proxyUrl.Host == "" {
+			return fmt.Errorf("Invalid proxy url %s", proxy)
+		}
+		config.proxy = proxyUrl
+		config.mark("WithProxy")
+		return nil
+	}
+}
+
+// The tls configuration used for https requests
+func WithTlsConfig(tlsConfig *tls.Config) Option {
+	return func(config *config) error {
+		config.tlsConfig = tlsConfig
+		config.mark("WithTlsConfig")
+		return nil
+	}
+}
+
+// See SetTlsOptions, the options are also used by WithTcpAddr when it's
+// given a nil tls configuration.
+func WithTlsOptions(options TlsOptions) Option {
+	return func(config *config) error {
+		tlsConfig, err := options.Config()
+		if err != nil {
+			return err
+		}
+		config.tlsConfig = tlsConfig
+		config.streamTlsConfig = tlsConfig
+		config.mark("WithTlsOptions")
+		return nil
+	}
+}
+
+// The timeout of http requests, DEFAULT_TIMEOUT by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(config *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("Timeout must be positive")
+		}
+		config.timeout = timeout
+		config.mark("WithTimeout")
+		return nil
+	}
+}
+
+// How often buffered points are sent, DEFAULT_FLUSH_INTERVAL by default
+func WithFlushInterval(interval time.Duration) Option {
+	return func(config *config) error {
+		if interval <= 0 {
+			return fmt.Errorf("Flush interval must be positive")
+		}
+		config.flushInterval = interval
+		return nil
+	}
+}
+
+// Buffered points are sent as soon as there are this many of them,
+// DEFAULT_BATCH_SIZE by default
+func WithBatchSize(size int) Option {
+	return func(config *config) error {
+		if size <= 0 {
+			return fmt.Errorf("Batch size must be positive")
+		}
+		config.batchSize = size
+		return nil
+	}
+}
+
+// The maximum number of points waiting to be sent, DEFAULT_QUEUE_SIZE by
+// default
+func WithQueueSize(size int) Option {
+	return func(config *config) error {
+		if size <= 0 {
+			return fmt.Errorf("Queue size must be positive")
+		}
+		config.queueSize = size
+		return nil
+	}
+}
+
+// See SetOverflowPolicy
+func WithOverflowPolicy(policy OverflowPolicy, timeout time.Duration) Option {
+	return func(config *config) error {
+		if err := validateOverflowPolicy(policy, timeout); err != nil {
+			return err
+		}
+		config.overflowPolicy = policy
+		config.overflowTimeout = timeout
+		return nil
+	}
+}
+
+// See SetCompression
+func WithCompression(compressor Compressor, threshold int) Option {
+	return func(config *config) error {
+		if err := validateCompression(compressor, threshold); err != nil {
+			return err
+		}
+		config.compressor = compressor
+		config.compressionThreshold = threshold
+		return nil
+	}
+}
+
+// See SetRateLimit
+func WithRateLimit(postType PostType, limit RateLimit) Option {
+	return func(config *config) error {
+		if err := validateRateLimit(limit); err != nil {
+			return err
+		}
+		if config.rateLimits == nil {
+			config.rateLimits = make(map[PostType]RateLimit)
+		}
+		config.rateLimits[postType] = limit
+		return nil
+	}
+}
+
+// See SetBreakerPolicy
+func WithBreakerPolicy(policy BreakerPolicy) Option {
+	return func(config *config) error {
+		if err := validateBreakerPolicy(policy); err != nil {
+			return err
+		}
+		config.breakerPolicy = policy
+		return nil
+	}
+}
+
+// See SetRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(config *config) error {
+		if err := validateRetryPolicy(policy); err != nil {
+			return err
+		}
+		config.retryPolicy = policy
+		return nil
+	}
+}
+
+// See SetErrorHandler. Errors are logged by default.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(config *config) error {
+		config.errorHandler = handler
+		return nil
+	}
+}
+
+// The logger used for warnings, and for errors if there's no error handler.
+// Errors and warnings are printed to stderr by default.
+func WithLogger(logger Logger) Option {
+	return func(config *config) error {
+		if logger == nil {
+			return fmt.Errorf("Logger cannot be nil")
+		}
+		config.logger = logger
+		return nil
+	}
+}
+
+// The clock used for timestamps and timers, the system clock by default.
+// Mostly useful in tests.
+func WithClock(clock Clock) Option {
+	return func(config *config) error {
+		if clock == nil {
+			return fmt.Errorf("Clock cannot be nil")
+		}
+		config.clock = clock
+		return nil
+	}
+}
+
+// See SetHttpClient. Cannot be combined with the proxy, tls and timeout
+// options, configure the client instead.
+func WithHttpClient(client *http.Client) Option {
+	return func(config *config) error {
+		if client == nil {
+			return fmt.Errorf("Http client cannot be nil")
+		}
+		config.httpClient = client
+		config.mark("WithHttpClient")
+		return nil
+	}
+}
+
+// See SetHttpTransport
+func WithHttpTransport(transport Transport) Option {
+	return func(config *config) error {
+		if transport == nil {
+			return fmt.Errorf("Http transport cannot be nil")
+		}
+		config.httpTransport = transport
+		config.mark("WithHttpTransport")
+		return nil
+	}
+}
+
+// See SetUdpTransport
+func WithUdpTransport(transport Transport) Option {
+	return func(config *config) error {
+		if transport == nil {
+			return fmt.Errorf("Udp transport cannot be nil")
+		}
+		config.udpTransport = transport
+		config.mark("WithUdpTransport")
+		return nil
+	}
+}
+
+// See EnableSpool
+func WithSpool(spoolConfig SpoolConfig) Option {
+	return func(config *config) error {
+		if err := validateSpoolConfig(spoolConfig); err != nil {
+			return err
+		}
+		config.spool = &spoolConfig
+		return nil
+	}
+}
+
+// See EnablePreAggregation
+func WithPreAggregation() Option {
+	return func(config *config) error {
+		config.preAggregation = true
+		return nil
+	}
+}
+
+// See SetNamePolicy
+func WithNamePolicy(policy NamePolicy) Option {
+	return func(config *config) error {
+		if err := validateNamePolicy(policy); err != nil {
+			return err
+		}
+		config.namePolicy = policy
+		return nil
+	}
+}
+
+// See SetDimensionRules
+func WithDimensionRules(rules DimensionRules) Option {
+	return func(config *config) error {
+		if err := validateDimensionRules(rules); err != nil {
+			return err
+		}
+		config.dimensionRules = &rules
+		return nil
+	}
+}
+
+// See SetCardinalityLimit
+func WithCardinalityLimit(limit CardinalityLimit) Option {
+	return func(config *config) error {
+		if err := validateCardinalityLimit(limit); err != nil {
+			return err
+		}
+		config.cardinalityLimit = &limit
+		return nil
+	}
+}
+
+// See SetPercentiles
+func WithPercentiles(percentiles ...float64) Option {
+	return func(config *config) error {
+		if err := validatePercentiles(percentiles); err != nil {
+			return err
+		}
+		config.percentiles = percentiles
+		return nil
+	}
+}
@@ -0,0 +1,139 @@
+package errplane
+
+import (
+	"crypto/tls"
+	. "launchpad.net/gocheck"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type OptionsSuite struct{}
+
+var _ = Suite(&OptionsSuite{})
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (self *fixedClock) Now() time.Time {
+	return self.now
+}
+
+var requiredOptions = []Option{WithApp("app4you2love", "staging"), WithApiKey("some_key")}
+
+func (s *OptionsSuite) TestValidatesOptions(c *C) {
+	invalid := []Option{
+		WithHttpScheme("ftp"),
+		WithHttpHost(""),
+		WithUdpAddr("no-port"),
+		WithProxy("not a url"),
+		WithTimeout(0),
+		WithFlushInterval(-time.Second),
+		WithBatchSize(0),
+		WithQueueSize(-1),
+		WithOverflowPolicy(OverflowBlockTimeout, 0),
+		WithRetryPolicy(RetryPolicy{Jitter: 2}),
+		WithClock(nil),
+		WithHttpTransport(nil),
+		WithSpool(SpoolConfig{}),
+		WithPercentiles(2),
+	}
+	for _, option := range invalid {
+		ep, err := NewWithOptions(append(requiredOptions, option)...)
+		c.Assert(err, NotNil)
+		c.Assert(ep, IsNil)
+	}
+
+	_, err := NewWithOptions(WithApiKey("some_key"))
+	c.Assert(err, NotNil)
+	_, err = NewWithOptions(WithApp("app4you2love", "staging"))
+	c.Assert(err, NotNil)
+}
+
+func (s *OptionsSuite) TestRejectsConflictingOptions(c *C) {
+	conflicting := [][]Option{
+		{WithHttpClient(&http.Client{}), WithProxy("http://proxy:3128")},
+		{WithHttpClient(&http.Client{}), WithTimeout(time.Second)},
+		{WithHttpClient(&http.Client{}), WithTlsConfig(&tls.Config{})},
+		{WithTcpAddr("localhost:8126", nil), WithUdpAddr("localhost:8126")},
+		{WithUdpTransport(&recordingTransport{}), WithTcpAddr("localhost:8126", nil)},
+		{WithHttpTransport(&recordingTransport{}), WithHttpHost("localhost")},
+		{WithTlsConfig(&tls.Config{}), WithTlsOptions(TlsOptions{})},
+	}
+	for _, options := range conflicting {
+		ep, err := NewWithOptions(append(requiredOptions, options...)...)
+		c.Assert(err, NotNil)
+		c.Assert(ep, IsNil)
+	}
+}
+
+func (s *OptionsSuite) TestSettersWhileReporting(c *C) {
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(&recordingTransport{}),
+		WithUdpTransport(&recordingTransport{}),
+		WithFlushInterval(time.Millisecond),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 200; i++ {
+			ep.Report("some_metric", 1, time.Now(), "", Dimensions{"host": "a"})
+			ep.Sum("some_sum", 1, "", nil)
+			ep.Histogram("some_histogram", 1, "", nil)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		ep.SetErrorHandler(func(error) {})
+		ep.SetLogger(defaultLogger)
+		c.Assert(ep.SetOverflowPolicy(OverflowDropNewest, 0), IsNil)
+		c.Assert(ep.SetDimensionRules(DEFAULT_DIMENSION_RULES), IsNil)
+		c.Assert(ep.SetCardinalityLimit(CardinalityLimit{MaxSeries: 10}), IsNil)
+		c.Assert(ep.SetNamePolicy(DEFAULT_NAME_POLICY), IsNil)
+		c.Assert(ep.SetTimeout(time.Second), IsNil)
+		ep.EnablePreAggregation()
+	}
+	wait.Wait()
+}
+
+func (s *OptionsSuite) TestBatchSizeAndFlushInterval(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithUdpTransport(transport),
+		WithBatchSize(2),
+		WithFlushInterval(time.Hour),
+	)...)
+	c.Assert(err, IsNil)
+
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(transport.sent(), HasLen, 1)
+	c.Assert(transport.sent()[0].Database, Equals, "app4you2lovestaging")
+	c.Assert(transport.sent()[0].ApiKey, Equals, "some_key")
+	ep.Close()
+}
+
+func (s *OptionsSuite) TestErrorHandlerAndClock(c *C) {
+	errors := make(chan error, 1)
+	clock := &fixedClock{time.Unix(1234567890, 0)}
+	transport := &recordingTransport{err: errCollectorDown}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(transport),
+		WithErrorHandler(func(err error) { errors <- err }),
+		WithClock(clock),
+	)...)
+	c.Assert(err, IsNil)
+
+	ep.Heartbeat("heartbeat_metric", time.Hour, "", nil)
+	time.Sleep(50 * time.Millisecond)
+	ep.Close()
+
+	c.Assert(<-errors, NotNil)
+	c.Assert(transport.sent(), HasLen, 1)
+	c.Assert(transport.sent()[0].Writes[0].Points[0].Time, Equals, int64(1234567890))
+}
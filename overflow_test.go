@@ -0,0 +1,58 @@
+package errplane
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type OverflowSuite struct{}
+
+var _ = Suite(&OverflowSuite{})
+
+// a client without a goroutine consuming the queue
+func newStalledClient(queueSize int, policy OverflowPolicy, timeout time.Duration) *Errplane {
+	ep := &Errplane{client: &client{msgChan: make(chan *ErrplanePost, queueSize)}}
+	ep.SetOverflowPolicy(policy, timeout)
+	return ep
+}
+
+func queuedValues(ep *Errplane) []float64 {
+	values := make([]float64, 0)
+	for _, post := range ep.drainQueue(nil) {
+		values = append(values, post.operation.Writes[0].Points[0].Value)
+	}
+	return values
+}
+
+func (s *OverflowSuite) TestDropNewest(c *C) {
+	ep := newStalledClient(2, OverflowDropNewest, 0)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 2, "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 3, "", nil), Equals, ErrQueueFull)
+	c.Assert(ep.DroppedPoints(), Equals, uint64(1))
+	c.Assert(queuedValues(ep), DeepEquals, []float64{1, 2})
+}
+
+func (s *OverflowSuite) TestDropOldest(c *C) {
+	ep := newStalledClient(2, OverflowDropOldest, 0)
+	for i := 1; i <= 4; i++ {
+		c.Assert(ep.Sum("some_metric", float64(i), "", nil), IsNil)
+	}
+	c.Assert(ep.DroppedPoints(), Equals, uint64(2))
+	c.Assert(queuedValues(ep), DeepEquals, []float64{3, 4})
+}
+
+func (s *OverflowSuite) TestBlockTimeout(c *C) {
+	ep := newStalledClient(1, OverflowBlockTimeout, 50*time.Millisecond)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	start := time.Now()
+	c.Assert(ep.Sum("some_metric", 2, "", nil), Equals, ErrQueueFull)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+	c.Assert(ep.DroppedPoints(), Equals, uint64(1))
+}
+
+func (s *OverflowSuite) TestRejectsInvalidPolicies(c *C) {
+	ep := newStalledClient(1, OverflowBlock, 0)
+	c.Assert(ep.SetOverflowPolicy(OverflowPolicy(42), 0), NotNil)
+	c.Assert(ep.SetOverflowPolicy(OverflowBlockTimeout, 0), NotNil)
+}
@@ -0,0 +1,203 @@
+package errplane
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitPolicy decides what happens to a batch that exceeds a RateLimit
+type RateLimitPolicy int
+
+const (
+	// Send the points that fit in the budget and drop the rest
+	RateLimitDrop RateLimitPolicy = iota
+	// Send an evenly spread sample of the points that fits in the budget
+	RateLimitDownsample
+	// Wait until the budget allows the whole batch, the queue fills up in
+	// the meantime and the OverflowPolicy applies. The final flush of Close
+	// and Shutdown doesn't wait.
+	RateLimitQueue
+)
+
+// RateLimit caps the points and bytes per second sent by a transport, the
+// buckets hold one second worth of tokens. Zero disables a limit. Bytes
+// are estimated from the json encoding of the batch. Spool replays always
+// wait for the budget, whatever the policy.
+type RateLimit struct {
+	PointsPerSecond float64
+	BytesPerSecond  float64
+	Policy          RateLimitPolicy
+}
+
+func (self RateLimit) enabled() bool {
+	return self.PointsPerSecond > 0 || self.BytesPerSecond > 0
+}
+
+func validateRateLimit(limit RateLimit) error {
+	if limit.PointsPerSecond < 0 || limit.BytesPerSecond < 0 {
+		return fmt.Errorf("Rate limits cannot be negative")
+	}
+	if limit.Policy < RateLimitDrop || limit.Policy > RateLimitQueue {
+		return fmt.Errorf("Unknown rate limit policy %d", limit.Policy)
+	}
+	return nil
+}
+
+// a token bucket, tokens can go negative when RateLimitQueue reserves more
+// than the bucket holds
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (self *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(self.last).Seconds(); elapsed > 0 {
+		self.tokens = math.Min(self.rate, self.tokens+elapsed*self.rate)
+		self.last = now
+	}
+}
+
+// the fraction of amount that can be taken right away
+func (self *tokenBucket) available(amount float64, now time.Time) float64 {
+	if self == nil || amount <= 0 {
+		return 1
+	}
+	self.refill(now)
+	return math.Max(0, math.Min(1, self.tokens/amount))
+}
+
+func (self *tokenBucket) take(amount float64) {
+	if self != nil {
+		self.tokens -= amount
+	}
+}
+
+// take amount and return how long to wait before using it
+func (self *tokenBucket) reserve(amount float64, now time.Time) time.Duration {
+	if self == nil {
+		return 0
+	}
+	self.refill(now)
+	self.tokens -= amount
+	if self.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-self.tokens / self.rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	limit RateLimit
+	clock Clock
+
+	lock   sync.Mutex
+	points *tokenBucket
+	bytes  *tokenBucket
+}
+
+func newRateLimiter(limit RateLimit, clock Clock) *rateLimiter {
+	if !limit.enabled() {
+		return nil
+	}
+	now := clock.Now()
+	return &rateLimiter{
+		limit:  limit,
+		clock:  clock,
+		points: newTokenBucket(limit.PointsPerSecond, now),
+		bytes:  newTokenBucket(limit.BytesPerSecond, now),
+	}
+}
+
+// Apply the limit to the operation. Returns the operation to send, nil if
+// every point was dropped, and how long to wait before sending it.
+func (self *rateLimiter) apply(operation *WriteOperation) (*WriteOperation, time.Duration) {
+	if self == nil {
+		return operation, 0
+	}
+	return self.applyPolicy(operation, self.limit.Policy)
+}
+
+// take the budget of the whole operation like RateLimitQueue, returns how
+// long to wait before sending it
+func (self *rateLimiter) reserve(operation *WriteOperation) time.Duration {
+	if self == nil {
+		return 0
+	}
+	_, wait := self.applyPolicy(operation, RateLimitQueue)
+	return wait
+}
+
+func (self *rateLimiter) applyPolicy(operation *WriteOperation, policy RateLimitPolicy) (*WriteOperation, time.Duration) {
+	points := float64(operation.pointCount())
+	bytes := 0.0
+	if self.bytes != nil {
+		if buf, err := json.Marshal(operation); err == nil {
+			bytes = float64(len(buf))
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := self.clock.Now()
+	if policy == RateLimitQueue {
+		return operation, maxDuration(self.points.reserve(points, now), self.bytes.reserve(bytes, now))
+	}
+
+	fraction := math.Min(self.points.available(points, now), self.bytes.available(bytes, now))
+	keep := int(math.Floor(fraction * points))
+	self.points.take(float64(keep))
+	if points > 0 {
+		self.bytes.take(bytes * float64(keep) / points)
+	}
+	if keep == 0 {
+		return nil, 0
+	}
+	return keepPoints(operation, keep, policy == RateLimitDownsample), 0
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Return a copy of the operation with keep of its points, either the first
+// ones or an evenly spread sample.
+func keepPoints(operation *WriteOperation, keep int, spread bool) *WriteOperation {
+	total := operation.pointCount()
+	if keep >= total {
+		return operation
+	}
+
+	result := &WriteOperation{Database: operation.Database, ApiKey: operation.ApiKey, Operation: operation.Operation}
+	index := 0
+	for _, series := range operation.Writes {
+		kept := &JsonPoints{Name: series.Name}
+		for _, point := range series.Points {
+			if spread {
+				// keep the point if it crosses a multiple of total/keep
+				if (index+1)*keep/total > index*keep/total {
+					kept.Points = append(kept.Points, point)
+				}
+			} else if index < keep {
+				kept.Points = append(kept.Points, point)
+			}
+			index++
+		}
+		if len(kept.Points) > 0 {
+			result.Writes = append(result.Writes, kept)
+		}
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+package errplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func rateLimitOperation(series, points int) *WriteOperation {
+	operation := &WriteOperation{Database: "app4you2lovestaging", ApiKey: "some_key", Operation: "r"}
+	for i := 0; i < series; i++ {
+		writes := &JsonPoints{Name: fmt.Sprintf("metric_%d", i)}
+		for j := 0; j < points; j++ {
+			writes.Points = append(writes.Points, &JsonPoint{Value: float64(j)})
+		}
+		operation.Writes = append(operation.Writes, writes)
+	}
+	return operation
+}
+
+func pointValues(operation *WriteOperation) map[string][]float64 {
+	values := make(map[string][]float64)
+	for _, series := range operation.Writes {
+		for _, point := range series.Points {
+			values[series.Name] = append(values[series.Name], point.Value)
+		}
+	}
+	return values
+}
+
+func (s *RateLimitSuite) TestDropsPointsOverTheBudget(c *C) {
+	clock := &fixedClock{now: time.Now()}
+	limiter := newRateLimiter(RateLimit{PointsPerSecond: 10, Policy: RateLimitDrop}, clock)
+
+	limited, wait := limiter.apply(rateLimitOperation(1, 25))
+	c.Assert(wait, Equals, time.Duration(0))
+	c.Assert(pointValues(limited), DeepEquals, map[string][]float64{"metric_0": {0, 1, 2, 3, 4, 5, 6, 7, 8, 9}})
+
+	limited, _ = limiter.apply(rateLimitOperation(1, 25))
+	c.Assert(limited, IsNil)
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	limited, _ = limiter.apply(rateLimitOperation(1, 25))
+	c.Assert(limited.pointCount(), Equals, 5)
+}
+
+func (s *RateLimitSuite) TestDownsamplesEvenly(c *C) {
+	limiter := newRateLimiter(RateLimit{PointsPerSecond: 5, Policy: RateLimitDownsample}, &fixedClock{now: time.Now()})
+
+	operation := rateLimitOperation(2, 5)
+	limited, _ := limiter.apply(operation)
+	c.Assert(pointValues(limited), DeepEquals, map[string][]float64{"metric_0": {1, 3}, "metric_1": {0, 2, 4}})
+	c.Assert(limited.ApiKey, Equals, "some_key")
+	c.Assert(operation.pointCount(), Equals, 10)
+}
+
+func (s *RateLimitSuite) TestLimitsBytes(c *C) {
+	operation := rateLimitOperation(1, 100)
+	buf, err := json.Marshal(operation)
+	c.Assert(err, IsNil)
+	size := len(buf)
+	limiter := newRateLimiter(RateLimit{BytesPerSecond: float64(size) / 4, Policy: RateLimitDrop}, &fixedClock{now: time.Now()})
+
+	limited, _ := limiter.apply(operation)
+	c.Assert(limited.pointCount(), Equals, 25)
+}
+
+func (s *RateLimitSuite) TestQueuesUntilTheBudgetAllows(c *C) {
+	limiter := newRateLimiter(RateLimit{PointsPerSecond: 10, Policy: RateLimitQueue}, &fixedClock{now: time.Now()})
+
+	limited, wait := limiter.apply(rateLimitOperation(1, 10))
+	c.Assert(limited.pointCount(), Equals, 10)
+	c.Assert(wait, Equals, time.Duration(0))
+
+	limited, wait = limiter.apply(rateLimitOperation(1, 15))
+	c.Assert(limited.pointCount(), Equals, 15)
+	c.Assert(wait, Equals, 1500*time.Millisecond)
+}
+
+func (s *RateLimitSuite) TestWithRateLimit(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport), WithClock(&fixedClock{now: time.Now()}),
+		WithRateLimit(HTTP, RateLimit{PointsPerSecond: 5}))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	for i := 0; i < 20; i++ {
+		c.Assert(ep.Report("some_metric", float64(i), time.Now(), "", nil), IsNil)
+	}
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	sent := 0
+	for _, operation := range transport.sent() {
+		sent += operation.pointCount()
+	}
+	c.Assert(sent, Equals, 5)
+	c.Assert(ep.Stats().RateLimited, Equals, uint64(15))
+}
+
+func (s *RateLimitSuite) TestLimitsSpoolReplay(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport), WithClock(&fixedClock{now: time.Now()}),
+		WithRateLimit(HTTP, RateLimit{PointsPerSecond: 5}))...)
+	c.Assert(err, IsNil)
+
+	c.Assert(ep.replay(HTTP, rateLimitOperation(1, 5)), IsNil)
+	c.Assert(transport.sent(), HasLen, 1)
+
+	// replays wait for the budget instead of dropping points, closing the
+	// client stops the wait and keeps the operation spooled
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ep.Close()
+	}()
+	c.Assert(ep.replay(HTTP, rateLimitOperation(1, 20)), Equals, errReplayStopped)
+	c.Assert(transport.sent(), HasLen, 1)
+	c.Assert(ep.Stats().RateLimited, Equals, uint64(0))
+
+	// the rest of the spool is kept once the client is closing
+	closed := newTestClient("app4you2love", "staging", "some_key")
+	closed.SetHttpTransport(transport)
+	closed.Close()
+	c.Assert(closed.replay(HTTP, rateLimitOperation(1, 1)), Equals, errReplayStopped)
+	c.Assert(isRetryable(errReplayStopped), Equals, true)
+	c.Assert(transport.sent(), HasLen, 1)
+}
+
+func (s *RateLimitSuite) TestReplayWaitsForTheBudget(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport),
+		WithRateLimit(HTTP, RateLimit{PointsPerSecond: 100, Policy: RateLimitDownsample}))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	start := time.Now()
+	c.Assert(ep.replay(HTTP, rateLimitOperation(1, 150)), IsNil)
+	c.Assert(time.Since(start) >= 400*time.Millisecond, Equals, true)
+	c.Assert(transport.sent(), HasLen, 1)
+	c.Assert(transport.sent()[0].pointCount(), Equals, 150)
+	c.Assert(ep.Stats().RateLimited, Equals, uint64(0))
+}
+
+func (s *RateLimitSuite) TestValidatesRateLimits(c *C) {
+	_, err := NewWithOptions(append(requiredOptions, WithRateLimit(UDP, RateLimit{PointsPerSecond: -1}))...)
+	c.Assert(err, ErrorMatches, ".*cannot be negative.*")
+
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	c.Assert(ep.SetRateLimit(UDP, RateLimit{Policy: RateLimitPolicy(42)}), ErrorMatches, "Unknown rate limit policy 42")
+	c.Assert(ep.SetRateLimit(UDP, RateLimit{}), IsNil)
+	c.Assert(ep.rateLimiters[UDP], IsNil)
+}
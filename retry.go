@@ -0,0 +1,144 @@
+package errplane
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed http writes are retried. The delay before
+// retry n is InitialBackoff * 2^n capped at MaxBackoff, Jitter is the
+// fraction of that delay that is randomized (0 disables jitter). The zero
+// value disables retries.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
+
+var DEFAULT_RETRY_POLICY = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Jitter:         0.2,
+}
+
+func validateRetryPolicy(policy RetryPolicy) error {
+	if policy.MaxRetries < 0 || policy.InitialBackoff < 0 || policy.MaxBackoff < 0 {
+		return fmt.Errorf("Retry policy cannot have negative values")
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("Retry jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func (self RetryPolicy) backoff(attempt int) time.Duration {
+	delay := self.InitialBackoff
+	for i := 0; i < attempt && delay > 0; i++ {
+		if self.MaxBackoff > 0 && delay >= self.MaxBackoff {
+			break
+		}
+		if delay > math.MaxInt64/2 {
+			delay = math.MaxInt64
+			break
+		}
+		delay *= 2
+	}
+	if self.MaxBackoff > 0 && delay > self.MaxBackoff {
+		delay = self.MaxBackoff
+	}
+	if self.Jitter > 0 {
+		jitter := float64(delay) * self.Jitter
+		jittered := float64(delay) - jitter + rand.Float64()*2*jitter
+		if jittered >= math.MaxInt64 {
+			return math.MaxInt64
+		}
+		delay = time.Duration(jittered)
+	}
+	return delay
+}
+
+// HttpError is returned when the server responds with an unexpected status code.
+type HttpError struct {
+	StatusCode int
+	// the value of the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (self *HttpError) Error() string {
+	return fmt.Sprintf("Server returned status code %d", self.StatusCode)
+}
+
+// Server errors and 429 (too many requests) are retryable, any other status
+// code is a permanent failure.
+func (self *HttpError) Retryable() bool {
+	return self.StatusCode >= 500 || self.StatusCode == http.StatusTooManyRequests
+}
+
+func newHttpError(resp *http.Response) *HttpError {
+	return &HttpError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// Retry-After is either a number of seconds or an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(time.Now()); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// Network errors and errors whose Retryable method returns true, such as
+// retryable http errors, can succeed if sent again later. Certificate and
+// tls handshake failures won't, even when wrapped in a network error.
+func isRetryable(err error) bool {
+	if isTlsError(err) {
+		return false
+	}
+	switch e := err.(type) {
+	case interface{ Retryable() bool }:
+		return e.Retryable()
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+func isTlsError(err error) bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		recordHeader     tls.RecordHeaderError
+		opErr            *net.OpError
+	)
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) ||
+		errors.As(err, &recordHeader) || errors.Is(err, errPinnedKeyMismatch) {
+		return true
+	}
+	// crypto/tls reports the alerts sent by the server, e.g. for a rejected
+	// client certificate, as a "remote error"
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
@@ -0,0 +1,129 @@
+package errplane
+
+import (
+	"crypto/x509"
+	"errors"
+	. "launchpad.net/gocheck"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func newStatusServer(statuses ...int) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		status := statuses[len(statuses)-1]
+		if requests < len(statuses) {
+			status = statuses[requests]
+		}
+		requests++
+		if status == http.StatusTooManyRequests {
+			writer.Header().Set("Retry-After", "2")
+		}
+		writer.WriteHeader(status)
+	}))
+	return server, &requests
+}
+
+func newRetryTestTransport(url string, delays *[]time.Duration) *HttpTransport {
+	transport := NewHttpTransport(url, nil)
+	transport.SetRetryPolicy(RetryPolicy{MaxRetries: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 5 * time.Second})
+	transport.sleep = func(delay time.Duration) { *delays = append(*delays, delay) }
+	return transport
+}
+
+func (s *RetrySuite) TestRetriesServerErrors(c *C) {
+	server, requests := newStatusServer(503, 500, 201)
+	defer server.Close()
+	delays := make([]time.Duration, 0)
+	transport := newRetryTestTransport(server.URL, &delays)
+
+	c.Assert(transport.Send(&WriteOperation{}), IsNil)
+	c.Assert(*requests, Equals, 3)
+	c.Assert(delays, DeepEquals, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond})
+}
+
+func (s *RetrySuite) TestGivesUpAfterMaxRetries(c *C) {
+	server, requests := newStatusServer(503)
+	defer server.Close()
+	delays := make([]time.Duration, 0)
+	transport := newRetryTestTransport(server.URL, &delays)
+
+	err := transport.Send(&WriteOperation{})
+	c.Assert(err, NotNil)
+	c.Assert(isRetryable(err), Equals, true)
+	c.Assert(*requests, Equals, 4)
+}
+
+func (s *RetrySuite) TestDoesNotRetryClientErrors(c *C) {
+	server, requests := newStatusServer(400)
+	defer server.Close()
+	delays := make([]time.Duration, 0)
+	transport := newRetryTestTransport(server.URL, &delays)
+
+	err := transport.Send(&WriteOperation{})
+	c.Assert(err, FitsTypeOf, &HttpError{})
+	c.Assert(err.(*HttpError).StatusCode, Equals, 400)
+	c.Assert(isRetryable(err), Equals, false)
+	c.Assert(*requests, Equals, 1)
+	c.Assert(delays, HasLen, 0)
+}
+
+func (s *RetrySuite) TestRespectsRetryAfter(c *C) {
+	server, requests := newStatusServer(429, 201)
+	defer server.Close()
+	delays := make([]time.Duration, 0)
+	transport := newRetryTestTransport(server.URL, &delays)
+
+	c.Assert(transport.Send(&WriteOperation{}), IsNil)
+	c.Assert(*requests, Equals, 2)
+	c.Assert(delays, DeepEquals, []time.Duration{2 * time.Second})
+}
+
+func (s *RetrySuite) TestBackoffIsCapped(c *C) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second, Jitter: 0.5}
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := policy.backoff(attempt)
+		c.Assert(delay <= 6*time.Second, Equals, true)
+		c.Assert(delay >= 500*time.Millisecond, Equals, true)
+	}
+	c.Assert(RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 4 * time.Second}.backoff(5), Equals, 4*time.Second)
+}
+
+func (s *RetrySuite) TestUncappedBackoffKeepsDoubling(c *C) {
+	policy := RetryPolicy{InitialBackoff: time.Second}
+	c.Assert(policy.backoff(0), Equals, time.Second)
+	c.Assert(policy.backoff(3), Equals, 8*time.Second)
+	c.Assert(policy.backoff(1000), Equals, time.Duration(math.MaxInt64))
+
+	policy.Jitter = 1
+	c.Assert(policy.backoff(1000) > 0, Equals, true)
+}
+
+func (s *RetrySuite) TestValidatesRetryPolicy(c *C) {
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(&recordingTransport{})
+	defer ep.Close()
+	c.Assert(ep.SetRetryPolicy(RetryPolicy{MaxRetries: -1}), ErrorMatches, ".*negative.*")
+	c.Assert(ep.SetRetryPolicy(RetryPolicy{Jitter: 2}), ErrorMatches, ".*jitter.*")
+	c.Assert(ep.SetRetryPolicy(RetryPolicy{}), IsNil)
+}
+
+func (s *RetrySuite) TestTlsErrorsAreNotRetryable(c *C) {
+	for _, err := range []error{
+		&url.Error{Op: "Post", URL: "https://collector", Err: x509.UnknownAuthorityError{}},
+		&url.Error{Op: "Post", URL: "https://collector", Err: x509.HostnameError{Host: "collector"}},
+		&url.Error{Op: "Post", URL: "https://collector", Err: errPinnedKeyMismatch},
+		&url.Error{Op: "Post", URL: "https://collector", Err: &net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}},
+	} {
+		c.Assert(isRetryable(err), Equals, false, Commentf("%v", err))
+	}
+	c.Assert(isRetryable(&url.Error{Op: "Post", URL: "https://collector", Err: errCollectorDown}), Equals, true)
+}
@@ -0,0 +1,64 @@
+package errplane
+
+// Return a view of this client that prepends prefix and a dot to the metric
+// names of all points. The view shares the queue and connections of its
+// parent, closing either closes both.
+//
+//	users := ep.WithPrefix("api.users")
+//	users.Sum("signups", 1, "", nil) // sends api.users.signups
+func (self *Errplane) WithPrefix(prefix string) *Errplane {
+	return &Errplane{
+		client:     self.client,
+		prefix:     joinMetricName(self.prefix, prefix),
+		dimensions: self.dimensions,
+	}
+}
+
+// Return a view of this client that adds dimensions to all points. The
+// dimensions of a point take precedence over the view's dimensions. The
+// view shares the queue and connections of its parent, closing either
+// closes both.
+func (self *Errplane) WithDimensions(dimensions Dimensions) *Errplane {
+	return &Errplane{
+		client:     self.client,
+		prefix:     self.prefix,
+		dimensions: mergeDimensions(self.dimensions, dimensions),
+	}
+}
+
+func (self *Errplane) scopedMetric(metric string) string {
+	return joinMetricName(self.prefix, metric)
+}
+
+func (self *Errplane) scopedDimensions(dimensions Dimensions) Dimensions {
+	if len(self.dimensions) == 0 {
+		return dimensions
+	}
+	return mergeDimensions(self.dimensions, dimensions)
+}
+
+func joinMetricName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + "." + name
+}
+
+// Return a new map with the dimensions of base and overrides, the values of
+// overrides take precedence.
+func mergeDimensions(base, overrides Dimensions) Dimensions {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := make(Dimensions, len(base)+len(overrides))
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	return merged
+}
@@ -0,0 +1,61 @@
+package errplane
+
+import (
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type ScopeSuite struct{}
+
+var _ = Suite(&ScopeSuite{})
+
+func (s *ScopeSuite) TestScopedClients(c *C) {
+	httpTransport := &recordingTransport{}
+	udpTransport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(httpTransport)
+	ep.SetUdpTransport(udpTransport)
+
+	scoped := ep.WithPrefix("api").WithDimensions(Dimensions{"host": "a", "region": "us"}).WithPrefix("users")
+	c.Assert(scoped.Report("logins", 1, time.Now(), "", Dimensions{"region": "eu"}), IsNil)
+	c.Assert(scoped.Sum("signups", 1, "", nil), IsNil)
+	c.Assert(scoped.Aggregate("latency", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("unscoped", 1, "", nil), IsNil)
+	ep.Close()
+
+	reports := pointsByName(httpTransport.sent(), "")
+	c.Assert(reports["api.users.logins"], HasLen, 1)
+	c.Assert(reports["api.users.logins"][0].Dimensions, DeepEquals, map[string]string{"host": "a", "region": "eu"})
+
+	sums := pointsByName(udpTransport.sent(), "c")
+	c.Assert(sums["api.users.signups"], HasLen, 1)
+	c.Assert(sums["api.users.signups"][0].Dimensions, DeepEquals, map[string]string{"host": "a", "region": "us"})
+	c.Assert(sums["unscoped"], HasLen, 1)
+	c.Assert(sums["unscoped"][0].Dimensions, IsNil)
+
+	timings := pointsByName(udpTransport.sent(), "t")
+	c.Assert(timings["api.users.latency"], HasLen, 1)
+}
+
+func (s *ScopeSuite) TestScopedHeartbeat(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(transport)
+
+	ep.WithPrefix("worker").WithDimensions(Dimensions{"host": "a"}).Heartbeat("alive", time.Hour, "", nil)
+	time.Sleep(50 * time.Millisecond)
+	ep.Close()
+
+	points := pointsByName(transport.sent(), "")["worker.alive"]
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Dimensions, DeepEquals, map[string]string{"host": "a"})
+}
+
+func (s *ScopeSuite) TestDoesNotModifyDimensions(c *C) {
+	defaults := Dimensions{"host": "a"}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	scoped := ep.WithDimensions(defaults)
+	defaults["host"] = "b"
+	c.Assert(scoped.dimensions, DeepEquals, Dimensions{"host": "a"})
+	ep.Close()
+}
@@ -0,0 +1,138 @@
+package errplane
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+	"sync"
+	"time"
+)
+
+type ShutdownSuite struct{}
+
+var _ = Suite(&ShutdownSuite{})
+
+func (s *ShutdownSuite) TestCloseIsIdempotent(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(transport)
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+
+	ep.Close()
+	ep.Close()
+	c.Assert(ep.Shutdown(context.Background()), IsNil)
+	c.Assert(transport.sent(), HasLen, 1)
+}
+
+func (s *ShutdownSuite) TestReturnsErrClosedAfterClose(c *C) {
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(&recordingTransport{})
+	ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), Equals, ErrClosed)
+	c.Assert(ep.WithPrefix("scoped").ReportUDP("some_metric", 1, "", nil), Equals, ErrClosed)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), Equals, ErrClosed)
+	c.Assert(ep.Aggregate("some_metric", 1, "", nil), Equals, ErrClosed)
+	c.Assert(ep.Histogram("some_metric", 1, "", nil), Equals, ErrClosed)
+}
+
+func (s *ShutdownSuite) TestShutdownDeadline(c *C) {
+	release := make(chan bool)
+	defer close(release)
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(TransportFunc(func(operation *WriteOperation) error {
+		<-release
+		return nil
+	}))
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Report("some_metric", 2, time.Now(), "", nil), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ep.Shutdown(ctx)
+	c.Assert(err, FitsTypeOf, &ShutdownError{})
+	c.Assert(err.(*ShutdownError).Lost, Equals, int64(2))
+	c.Assert(err.(*ShutdownError).Err, Equals, context.DeadlineExceeded)
+}
+
+func (s *ShutdownSuite) TestLostIncludesAggregatedPoints(c *C) {
+	release := make(chan bool)
+	defer close(release)
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(TransportFunc(func(operation *WriteOperation) error {
+		<-release
+		return nil
+	}))
+	ep.SetUdpTransport(&recordingTransport{})
+	ep.EnablePreAggregation()
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Sum("some_sum", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("some_sum", 2, "", nil), IsNil)
+	c.Assert(ep.Histogram("some_histogram", 1, "", nil), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := ep.Shutdown(ctx)
+	c.Assert(err, FitsTypeOf, &ShutdownError{})
+	// one report, one sum and a point per percentile
+	c.Assert(err.(*ShutdownError).Lost, Equals, int64(2+len(DEFAULT_PERCENTILES)))
+}
+
+func (s *ShutdownSuite) TestPointsEnqueuedDuringShutdownAreFlushed(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(transport)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for ep.Report("some_metric", 1, time.Now(), "", nil) != ErrClosed {
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	ep.Close()
+	wait.Wait()
+
+	sent := 0
+	for _, operation := range transport.sent() {
+		sent += operation.pointCount()
+	}
+	c.Assert(uint64(sent), Equals, ep.Stats().Enqueued)
+}
+
+func (s *ShutdownSuite) TestDeadlineStopsRetries(c *C) {
+	server, _ := newStatusServer(503)
+	defer server.Close()
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpScheme("http"),
+		WithHttpHost(server.Listener.Addr().String()),
+		WithRetryPolicy(RetryPolicy{MaxRetries: 5, InitialBackoff: 10 * time.Second}),
+		WithErrorHandler(func(error) {}),
+	)...)
+	c.Assert(err, IsNil)
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(ep.Shutdown(ctx), FitsTypeOf, &ShutdownError{})
+	select {
+	case <-ep.done:
+	case <-time.After(time.Second):
+		c.Fatal("The final flush kept retrying after the deadline")
+	}
+}
+
+func (s *ShutdownSuite) TestHeartbeatStopsAfterClose(c *C) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(transport)
+	ep.Heartbeat("heartbeat_metric", 10*time.Millisecond, "", nil)
+	time.Sleep(50 * time.Millisecond)
+	ep.Close()
+
+	sent := len(transport.sent())
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(transport.sent(), HasLen, sent)
+}
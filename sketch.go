@@ -0,0 +1,155 @@
+package errplane
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	DEFAULT_SKETCH_ACCURACY = 0.01
+
+	// values closer to zero than this are counted as zero
+	sketchMinValue = 1e-9
+)
+
+// Sketch is a mergeable quantile sketch (DDSketch). Values are counted in
+// logarithmically sized buckets, so every quantile is estimated within the
+// sketch's relative accuracy no matter how the values are distributed.
+type Sketch struct {
+	accuracy  float64
+	logGamma  float64
+	positive  map[int]uint64
+	negative  map[int]uint64
+	zeroCount uint64
+	count     uint64
+	min       float64
+	max       float64
+}
+
+// Create a sketch with the given relative accuracy, e.g. 0.01 for quantiles
+// that are within 1% of the real value.
+func NewSketch(relativeAccuracy float64) (*Sketch, error) {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return nil, fmt.Errorf("Sketch accuracy must be between 0 and 1, got %v", relativeAccuracy)
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &Sketch{
+		accuracy: relativeAccuracy,
+		logGamma: math.Log(gamma),
+		positive: make(map[int]uint64),
+		negative: make(map[int]uint64),
+	}, nil
+}
+
+func (self *Sketch) index(value float64) int {
+	return int(math.Ceil(math.Log(value) / self.logGamma))
+}
+
+// the value in the middle of the bucket, which is within the relative
+// accuracy of all values in the bucket
+func (self *Sketch) value(index int) float64 {
+	gamma := math.Exp(self.logGamma)
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+func (self *Sketch) Add(value float64) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	switch {
+	case value > sketchMinValue:
+		self.positive[self.index(value)]++
+	case value < -sketchMinValue:
+		self.negative[self.index(-value)]++
+	default:
+		self.zeroCount++
+	}
+	if self.count == 0 || value < self.min {
+		self.min = value
+	}
+	if self.count == 0 || value > self.max {
+		self.max = value
+	}
+	self.count++
+}
+
+// Add all values of other to this sketch, both sketches must have the same
+// relative accuracy.
+func (self *Sketch) Merge(other *Sketch) error {
+	if other.accuracy != self.accuracy {
+		return fmt.Errorf("Cannot merge sketches with accuracy %v and %v", self.accuracy, other.accuracy)
+	}
+	if other.count == 0 {
+		return nil
+	}
+	for index, count := range other.positive {
+		self.positive[index] += count
+	}
+	for index, count := range other.negative {
+		self.negative[index] += count
+	}
+	self.zeroCount += other.zeroCount
+	if self.count == 0 || other.min < self.min {
+		self.min = other.min
+	}
+	if self.count == 0 || other.max > self.max {
+		self.max = other.max
+	}
+	self.count += other.count
+	return nil
+}
+
+func (self *Sketch) Count() uint64 {
+	return self.count
+}
+
+// Estimate the value at quantile q, which must be between 0 and 1. Returns
+// NaN if the sketch is empty.
+func (self *Sketch) Quantile(q float64) float64 {
+	if self.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	if q == 0 {
+		return self.min
+	}
+	if q == 1 {
+		return self.max
+	}
+
+	rank := uint64(q * float64(self.count-1))
+	var seen uint64
+
+	// negative values in ascending order have descending indexes
+	negative := sortedIndexes(self.negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		seen += self.negative[negative[i]]
+		if seen > rank {
+			return self.clamp(-self.value(negative[i]))
+		}
+	}
+	seen += self.zeroCount
+	if seen > rank {
+		return 0
+	}
+	for _, index := range sortedIndexes(self.positive) {
+		seen += self.positive[index]
+		if seen > rank {
+			return self.clamp(self.value(index))
+		}
+	}
+	return self.max
+}
+
+func (self *Sketch) clamp(value float64) float64 {
+	return math.Max(self.min, math.Min(self.max, value))
+}
+
+func sortedIndexes(buckets map[int]uint64) []int {
+	indexes := make([]int, 0, len(buckets))
+	for index := range buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
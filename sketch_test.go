@@ -0,0 +1,72 @@
+package errplane
+
+import (
+	. "launchpad.net/gocheck"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+type SketchSuite struct{}
+
+var _ = Suite(&SketchSuite{})
+
+func assertWithinAccuracy(c *C, sketch *Sketch, values []float64, accuracy float64) {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	for _, q := range []float64{0, 0.1, 0.5, 0.9, 0.99, 0.999, 1} {
+		expected := sorted[int(q*float64(len(sorted)-1))]
+		actual := sketch.Quantile(q)
+		c.Assert(math.Abs(actual-expected) <= accuracy*math.Abs(expected), Equals, true,
+			Commentf("quantile %v: expected %v got %v", q, expected, actual))
+	}
+}
+
+func (s *SketchSuite) TestQuantiles(c *C) {
+	sketch, err := NewSketch(0.01)
+	c.Assert(err, IsNil)
+	values := make([]float64, 0)
+	for i := 0; i < 10000; i++ {
+		value := rand.ExpFloat64() * 100
+		values = append(values, value)
+		sketch.Add(value)
+	}
+	c.Assert(sketch.Count(), Equals, uint64(10000))
+	assertWithinAccuracy(c, sketch, values, 0.01)
+}
+
+func (s *SketchSuite) TestNegativeAndZeroValues(c *C) {
+	sketch, _ := NewSketch(0.01)
+	values := []float64{-100, -10, -1, 0, 0, 1, 10, 100}
+	for _, value := range values {
+		sketch.Add(value)
+	}
+	assertWithinAccuracy(c, sketch, values, 0.01)
+}
+
+func (s *SketchSuite) TestMerge(c *C) {
+	a, _ := NewSketch(0.02)
+	b, _ := NewSketch(0.02)
+	values := make([]float64, 0)
+	for i := 1; i <= 1000; i++ {
+		values = append(values, float64(i))
+		if i%2 == 0 {
+			a.Add(float64(i))
+		} else {
+			b.Add(float64(i))
+		}
+	}
+	c.Assert(a.Merge(b), IsNil)
+	c.Assert(a.Count(), Equals, uint64(1000))
+	assertWithinAccuracy(c, a, values, 0.02)
+
+	other, _ := NewSketch(0.05)
+	c.Assert(a.Merge(other), NotNil)
+}
+
+func (s *SketchSuite) TestInvalidAccuracy(c *C) {
+	_, err := NewSketch(0)
+	c.Assert(err, NotNil)
+	_, err = NewSketch(1)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,25 @@
+//go:build go1.21
+
+package errplane
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// Adapt a logger from the log/slog package
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger}
+}
+
+func (self *slogLogger) Warnf(format string, args ...interface{}) {
+	self.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func (self *slogLogger) Errorf(format string, args ...interface{}) {
+	self.logger.Error(fmt.Sprintf(format, args...))
+}
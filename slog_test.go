@@ -0,0 +1,26 @@
+//go:build go1.21
+
+package errplane
+
+import (
+	"bytes"
+	. "launchpad.net/gocheck"
+	"log/slog"
+	"strings"
+)
+
+type SlogSuite struct{}
+
+var _ = Suite(&SlogSuite{})
+
+func (s *SlogSuite) TestSlogLogger(c *C) {
+	buffer := &bytes.Buffer{}
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(buffer, nil)))
+	logger.Warnf("queue is %d%% full", 90)
+	logger.Errorf("collector is down")
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(strings.Contains(lines[0], `level=WARN msg="queue is 90% full"`), Equals, true)
+	c.Assert(strings.Contains(lines[1], `level=ERROR msg="collector is down"`), Equals, true)
+}
@@ -0,0 +1,399 @@
+package errplane
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolConfig configures the on-disk spool that keeps batches which couldn't
+// be delivered because of a retryable error. Zero values are replaced by the
+// DEFAULT_SPOOL_* constants.
+type SpoolConfig struct {
+	// the directory that holds the segment files
+	Dir string
+	// the oldest segments are removed once the spool grows past this size
+	MaxBytes int64
+	// batches older than this are discarded instead of being replayed
+	MaxAge time.Duration
+	// a new segment is started once the current one grows past this size
+	SegmentSize int64
+	// how often the spool is replayed
+	ReplayInterval time.Duration
+}
+
+const (
+	DEFAULT_SPOOL_MAX_BYTES       = 64 * 1024 * 1024
+	DEFAULT_SPOOL_MAX_AGE         = 24 * time.Hour
+	DEFAULT_SPOOL_SEGMENT_SIZE    = 1024 * 1024
+	DEFAULT_SPOOL_REPLAY_INTERVAL = 10 * time.Second
+
+	spoolSegmentSuffix = ".seg"
+	spoolHeaderSize    = 8
+)
+
+func (self SpoolConfig) withDefaults() SpoolConfig {
+	if self.MaxBytes <= 0 {
+		self.MaxBytes = DEFAULT_SPOOL_MAX_BYTES
+	}
+	if self.MaxAge <= 0 {
+		self.MaxAge = DEFAULT_SPOOL_MAX_AGE
+	}
+	if self.SegmentSize <= 0 {
+		self.SegmentSize = DEFAULT_SPOOL_SEGMENT_SIZE
+		if self.SegmentSize > self.MaxBytes {
+			self.SegmentSize = self.MaxBytes
+		}
+	}
+	if self.ReplayInterval <= 0 {
+		self.ReplayInterval = DEFAULT_SPOOL_REPLAY_INTERVAL
+	}
+	return self
+}
+
+// the active segment is never removed, so it can't be larger than the spool
+func validateSpoolConfig(config SpoolConfig) error {
+	if config.Dir == "" {
+		return fmt.Errorf("Spool directory cannot be empty")
+	}
+	if config = config.withDefaults(); config.SegmentSize > config.MaxBytes {
+		return fmt.Errorf("Spool segment size %d cannot be larger than the maximum spool size %d", config.SegmentSize, config.MaxBytes)
+	}
+	return nil
+}
+
+type replayStoppedError struct{}
+
+func (self replayStoppedError) Error() string {
+	return "Errplane client is closing, spool replay stopped"
+}
+
+// the operation stays in the spool for the next process
+func (self replayStoppedError) Retryable() bool {
+	return true
+}
+
+// returned when a spooled operation is replayed while the client is closing
+var errReplayStopped error = replayStoppedError{}
+
+type spoolEntry struct {
+	PostType  PostType        `json:"p"`
+	Time      int64           `json:"t"`
+	Operation *WriteOperation `json:"o"`
+}
+
+type spoolSegment struct {
+	id   uint64
+	size int64
+}
+
+// spool is a write-ahead log of undelivered operations split in segment
+// files. Every record is prefixed with its length and crc32 checksum, and is
+// synced to disk before append returns, so a torn write at the end of a
+// segment after a crash is detected and ignored on replay.
+type spool struct {
+	lock     sync.Mutex
+	config   SpoolConfig
+	segments []*spoolSegment
+	active   *os.File
+	size     int64
+	nextId   uint64
+}
+
+func openSpool(config SpoolConfig) (*spool, error) {
+	if err := validateSpoolConfig(config); err != nil {
+		return nil, err
+	}
+	config = config.withDefaults()
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	names, err := filepath.Glob(filepath.Join(config.Dir, "*"+spoolSegmentSuffix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	self := &spool{config: config, segments: make([]*spoolSegment, 0)}
+	for _, name := range names {
+		base := filepath.Base(name)
+		if !strings.HasSuffix(base, spoolSegmentSuffix) {
+			// left over from an interrupted rewrite
+			os.Remove(name)
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(base, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		self.segments = append(self.segments, &spoolSegment{id, info.Size()})
+		self.size += info.Size()
+		if id >= self.nextId {
+			self.nextId = id + 1
+		}
+	}
+	sort.Sort(spoolSegmentsById(self.segments))
+	return self, nil
+}
+
+type spoolSegmentsById []*spoolSegment
+
+func (self spoolSegmentsById) Len() int           { return len(self) }
+func (self spoolSegmentsById) Less(i, j int) bool { return self[i].id < self[j].id }
+func (self spoolSegmentsById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *spool) path(id uint64) string {
+	return filepath.Join(self.config.Dir, fmt.Sprintf("%020d%s", id, spoolSegmentSuffix))
+}
+
+func encodeSpoolRecord(entry *spoolEntry) ([]byte, error) {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, spoolHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolHeaderSize:], payload)
+	return record, nil
+}
+
+// Append the operation to the active segment
+func (self *spool) append(postType PostType, operation *WriteOperation) error {
+	record, err := encodeSpoolRecord(&spoolEntry{postType, time.Now().UnixNano(), operation})
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.active != nil {
+		last := self.segments[len(self.segments)-1]
+		if last.size+int64(len(record)) > self.config.SegmentSize {
+			self.seal()
+		}
+	}
+	if self.active == nil {
+		id := self.nextId
+		self.nextId++
+		file, err := os.OpenFile(self.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		self.active = file
+		self.segments = append(self.segments, &spoolSegment{id: id})
+	}
+
+	if _, err := self.active.Write(record); err != nil {
+		return err
+	}
+	if err := self.active.Sync(); err != nil {
+		return err
+	}
+	self.segments[len(self.segments)-1].size += int64(len(record))
+	self.size += int64(len(record))
+
+	// make room by removing the oldest segments
+	for self.size > self.config.MaxBytes && len(self.segments) > 1 {
+		self.remove(self.segments[0])
+	}
+	return nil
+}
+
+// close the active segment, the next append will start a new one. Must be
+// called with the lock held.
+func (self *spool) seal() {
+	if self.active != nil {
+		self.active.Close()
+		self.active = nil
+	}
+}
+
+// Must be called with the lock held.
+func (self *spool) remove(segment *spoolSegment) {
+	for i, s := range self.segments {
+		if s != segment {
+			continue
+		}
+		if i == len(self.segments)-1 {
+			self.seal()
+		}
+		os.Remove(self.path(segment.id))
+		self.size -= segment.size
+		self.segments = append(self.segments[:i], self.segments[i+1:]...)
+		return
+	}
+}
+
+// the size of the spool in bytes
+func (self *spool) bytes() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.size
+}
+
+func (self *spool) contains(segment *spoolSegment) bool {
+	for _, s := range self.segments {
+		if s == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// Send every spooled operation oldest first. Replay stops at the first
+// retryable error and keeps the operations that weren't delivered for the
+// next attempt. Operations that fail with any other error are removed and
+// passed to drop, if it isn't nil.
+func (self *spool) replay(send func(PostType, *WriteOperation) error, drop func(PostType, *WriteOperation, error)) (int, error) {
+	self.lock.Lock()
+	self.seal()
+	segments := append([]*spoolSegment{}, self.segments...)
+	self.lock.Unlock()
+
+	replayed := 0
+	oldest := time.Now().Add(-self.config.MaxAge).UnixNano()
+	for _, segment := range segments {
+		entries, err := self.read(segment)
+		if err != nil {
+			return replayed, err
+		}
+
+		for i, entry := range entries {
+			if entry.Time < oldest || entry.Operation == nil {
+				continue
+			}
+			if err := send(entry.PostType, entry.Operation); err != nil {
+				if isRetryable(err) {
+					var partial *PartialSendError
+					if errors.As(err, &partial) {
+						// keep only the points that weren't sent
+						entries[i] = &spoolEntry{entry.PostType, entry.Time, partial.Remaining}
+					}
+					if rewriteErr := self.rewrite(segment, entries[i:]); rewriteErr != nil {
+						return replayed, fmt.Errorf("Cannot remove the replayed operations from the spool, they will be sent again. Error: %s", rewriteErr)
+					}
+					return replayed, err
+				}
+				if drop != nil {
+					drop(entry.PostType, entry.Operation, err)
+				}
+				continue
+			}
+			replayed++
+		}
+
+		self.lock.Lock()
+		self.remove(segment)
+		self.lock.Unlock()
+	}
+	return replayed, nil
+}
+
+// Read all valid records from the segment, a truncated or corrupted record
+// ends the segment.
+func (self *spool) read(segment *spoolSegment) ([]*spoolEntry, error) {
+	file, err := os.Open(self.path(segment.id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*spoolEntry, 0)
+	reader := bufio.NewReader(file)
+	header := make([]byte, spoolHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if int64(length) > info.Size() {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+		entry := &spoolEntry{}
+		if err := json.Unmarshal(payload, entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Replace the segment with the given entries, the new content is written to
+// a temporary file first and renamed over the segment.
+func (self *spool) rewrite(segment *spoolSegment, entries []*spoolEntry) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if !self.contains(segment) {
+		return nil
+	}
+
+	path := self.path(segment.id)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, entry := range entries {
+		record, err := encodeSpoolRecord(entry)
+		if err == nil {
+			_, err = tmp.Write(record)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		size += int64(len(record))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	self.size += size - segment.size
+	segment.size = size
+	return nil
+}
+
+func (self *spool) close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.seal()
+	return nil
+}
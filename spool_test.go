@@ -0,0 +1,226 @@
+package errplane
+
+import (
+	"context"
+	"errors"
+	. "launchpad.net/gocheck"
+	"net"
+	"os"
+	"time"
+)
+
+type SpoolSuite struct{}
+
+var _ = Suite(&SpoolSuite{})
+
+var errCollectorDown = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func spoolOperation(name string) *WriteOperation {
+	return &WriteOperation{
+		Database: "app4you2lovestaging",
+		Writes:   []*JsonPoints{{Name: name, Points: []*JsonPoint{{Value: 1}}}},
+	}
+}
+
+func replayedNames(s *spool) ([]string, error) {
+	names := make([]string, 0)
+	_, err := s.replay(func(postType PostType, operation *WriteOperation) error {
+		names = append(names, operation.Writes[0].Name)
+		return nil
+	}, nil)
+	return names, err
+}
+
+// poll until the condition holds, fails the test after 5 seconds
+func waitFor(c *C, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.Fatal("Timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *SpoolSuite) TestReplaysInOrder(c *C) {
+	spool, err := openSpool(SpoolConfig{Dir: c.MkDir(), SegmentSize: 150})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		c.Assert(spool.append(HTTP, spoolOperation(name)), IsNil)
+	}
+	c.Assert(len(spool.segments) > 1, Equals, true)
+
+	names, err := replayedNames(spool)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"a", "b", "c", "d"})
+	c.Assert(spool.segments, HasLen, 0)
+	c.Assert(spool.size, Equals, int64(0))
+}
+
+func (s *SpoolSuite) TestKeepsUndeliveredOperationsAcrossRestarts(c *C) {
+	dir := c.MkDir()
+	spool, err := openSpool(SpoolConfig{Dir: dir})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b", "c"} {
+		c.Assert(spool.append(UDP, spoolOperation(name)), IsNil)
+	}
+
+	count := 0
+	replayed, err := spool.replay(func(postType PostType, operation *WriteOperation) error {
+		c.Assert(postType, Equals, UDP)
+		if count++; count > 1 {
+			return errCollectorDown
+		}
+		return nil
+	}, nil)
+	c.Assert(err, Equals, errCollectorDown)
+	c.Assert(replayed, Equals, 1)
+	spool.close()
+
+	// simulate a crash by opening the same directory again
+	spool, err = openSpool(SpoolConfig{Dir: dir})
+	c.Assert(err, IsNil)
+	names, err := replayedNames(spool)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"b", "c"})
+}
+
+func (s *SpoolSuite) TestIgnoresTornWrites(c *C) {
+	dir := c.MkDir()
+	spool, err := openSpool(SpoolConfig{Dir: dir})
+	c.Assert(err, IsNil)
+	c.Assert(spool.append(HTTP, spoolOperation("a")), IsNil)
+	path := spool.path(spool.segments[0].id)
+	spool.close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	file.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	file.Close()
+
+	spool, err = openSpool(SpoolConfig{Dir: dir})
+	c.Assert(err, IsNil)
+	names, err := replayedNames(spool)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"a"})
+}
+
+func (s *SpoolSuite) TestMaxBytesRemovesOldestSegments(c *C) {
+	spool, err := openSpool(SpoolConfig{Dir: c.MkDir(), SegmentSize: 100, MaxBytes: 300})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		c.Assert(spool.append(HTTP, spoolOperation(name)), IsNil)
+	}
+	c.Assert(spool.size <= 300, Equals, true)
+
+	names, err := replayedNames(spool)
+	c.Assert(err, IsNil)
+	c.Assert(len(names) < 6, Equals, true)
+	c.Assert(names[len(names)-1], Equals, "f")
+}
+
+func (s *SpoolSuite) TestMaxAgeDiscardsOldOperations(c *C) {
+	spool, err := openSpool(SpoolConfig{Dir: c.MkDir(), MaxAge: time.Millisecond})
+	c.Assert(err, IsNil)
+	c.Assert(spool.append(HTTP, spoolOperation("a")), IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	names, err := replayedNames(spool)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+	c.Assert(spool.segments, HasLen, 0)
+}
+
+func (s *SpoolSuite) TestSpoolsFailedBatches(c *C) {
+	transport := &recordingTransport{err: errCollectorDown}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(transport)
+	c.Assert(ep.SetBreakerPolicy(BreakerPolicy{Failures: 5, Cooldown: 50 * time.Millisecond}), IsNil)
+	c.Assert(ep.EnableSpool(SpoolConfig{Dir: c.MkDir(), ReplayInterval: 50 * time.Millisecond}), IsNil)
+
+	c.Assert(ep.Report("some_metric", 1.0, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), NotNil)
+	c.Assert(ep.spool.bytes() > 0, Equals, true)
+
+	transport.lock.Lock()
+	transport.err = nil
+	transport.operations = nil
+	transport.lock.Unlock()
+	waitFor(c, func() bool { return len(transport.sent()) > 0 })
+
+	c.Assert(transport.sent(), HasLen, 1)
+	c.Assert(transport.sent()[0].Writes[0].Name, Equals, "some_metric")
+	waitFor(c, func() bool { return ep.spool.bytes() == 0 })
+	c.Assert(ep.Stats().Flushed, Equals, uint64(1))
+	ep.Close()
+}
+
+func (s *SpoolSuite) TestDropsPermanentlyFailingOperations(c *C) {
+	spool, err := openSpool(SpoolConfig{Dir: c.MkDir()})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b", "c"} {
+		c.Assert(spool.append(HTTP, spoolOperation(name)), IsNil)
+	}
+
+	sent, dropped := []string{}, []string{}
+	replayed, err := spool.replay(func(postType PostType, operation *WriteOperation) error {
+		if operation.Writes[0].Name == "b" {
+			return &HttpError{StatusCode: 400}
+		}
+		sent = append(sent, operation.Writes[0].Name)
+		return nil
+	}, func(postType PostType, operation *WriteOperation, err error) {
+		dropped = append(dropped, operation.Writes[0].Name)
+	})
+	c.Assert(err, IsNil)
+	c.Assert(replayed, Equals, 2)
+	c.Assert(sent, DeepEquals, []string{"a", "c"})
+	c.Assert(dropped, DeepEquals, []string{"b"})
+	c.Assert(spool.bytes(), Equals, int64(0))
+}
+
+func (s *SpoolSuite) TestReportsFailedRewrites(c *C) {
+	dir := c.MkDir()
+	spool, err := openSpool(SpoolConfig{Dir: dir})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b"} {
+		c.Assert(spool.append(HTTP, spoolOperation(name)), IsNil)
+	}
+
+	_, err = spool.replay(func(postType PostType, operation *WriteOperation) error {
+		if operation.Writes[0].Name == "b" {
+			os.RemoveAll(dir)
+			return errCollectorDown
+		}
+		return nil
+	}, nil)
+	c.Assert(err, ErrorMatches, "Cannot remove the replayed operations from the spool.*")
+}
+
+func (s *SpoolSuite) TestValidatesSegmentSize(c *C) {
+	_, err := openSpool(SpoolConfig{Dir: c.MkDir(), SegmentSize: 200, MaxBytes: 100})
+	c.Assert(err, ErrorMatches, "Spool segment size 200 cannot be larger than the maximum spool size 100")
+	_, err = NewWithOptions(append(requiredOptions, WithSpool(SpoolConfig{Dir: c.MkDir(), SegmentSize: 200, MaxBytes: 100}))...)
+	c.Assert(err, NotNil)
+
+	spool, err := openSpool(SpoolConfig{Dir: c.MkDir(), MaxBytes: 1024})
+	c.Assert(err, IsNil)
+	c.Assert(spool.config.SegmentSize, Equals, int64(1024))
+}
+
+func (s *SpoolSuite) TestKeepsTheUnsentPartOfAnOperation(c *C) {
+	spool, err := openSpool(SpoolConfig{Dir: c.MkDir()})
+	c.Assert(err, IsNil)
+	for _, name := range []string{"a", "b"} {
+		c.Assert(spool.append(UDP, spoolOperation(name)), IsNil)
+	}
+
+	_, err = spool.replay(func(postType PostType, operation *WriteOperation) error {
+		return &PartialSendError{Remaining: spoolOperation("a_rest"), Err: errCollectorDown}
+	}, nil)
+	c.Assert(err, FitsTypeOf, &PartialSendError{})
+
+	names, err := replayedNames(spool)
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"a_rest", "b"})
+}
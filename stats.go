@@ -0,0 +1,135 @@
+package errplane
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ClientStats is a snapshot of the counters the client keeps about itself.
+// All counters are totals since the client was created. Points are counted
+// as they're sent: with pre-aggregation a series counts as the points it's
+// flushed as rather than as the calls to Sum or Aggregate, and the same goes
+// for histograms.
+type ClientStats struct {
+	// points put in the queue by Report, Sum, etc., and the points flushed
+	// by pre-aggregation and histograms
+	Enqueued uint64
+	// points that were delivered
+	Flushed uint64
+	// points dropped because the queue was full
+	Dropped uint64
+	// points dropped or downsampled away by a RateLimit
+	RateLimited uint64
+	// points dropped or moved to the overflow series by a CardinalityLimit
+	CardinalityLimited uint64
+	// http requests that were retried
+	Retried uint64
+	// points that couldn't be delivered per transport type (http or udp)
+	Failed map[string]uint64
+	// bytes written by the built-in transports
+	BytesSent uint64
+	// points waiting to be delivered, including the ones already taken
+	// from the queue for the next flush
+	QueueDepth int
+	// how long the last flush took
+	FlushLatency time.Duration
+}
+
+// the counters are updated atomically
+type clientStats struct {
+	enqueued           uint64
+	flushed            uint64
+	retried            uint64
+	httpFailed         uint64
+	udpFailed          uint64
+	bytesSent          uint64
+	rateLimited        uint64
+	cardinalityLimited uint64
+	flushLatency       int64
+}
+
+// the methods are safe to call on a nil *clientStats, which is what custom
+// transports get
+
+func (self *clientStats) addRetry() {
+	if self != nil {
+		atomic.AddUint64(&self.retried, 1)
+	}
+}
+
+func (self *clientStats) addBytes(count int) {
+	if self != nil {
+		atomic.AddUint64(&self.bytesSent, uint64(count))
+	}
+}
+
+func (self *clientStats) addFailed(postType PostType, count int) {
+	if postType == UDP {
+		atomic.AddUint64(&self.udpFailed, uint64(count))
+	} else {
+		atomic.AddUint64(&self.httpFailed, uint64(count))
+	}
+}
+
+func (self *Errplane) Stats() ClientStats {
+	return ClientStats{
+		Enqueued: atomic.LoadUint64(&self.stats.enqueued),
+		Flushed:  atomic.LoadUint64(&self.stats.flushed),
+		Dropped:  atomic.LoadUint64(&self.droppedPoints),
+		Retried:  atomic.LoadUint64(&self.stats.retried),
+		Failed: map[string]uint64{
+			HTTP.String(): atomic.LoadUint64(&self.stats.httpFailed),
+			UDP.String():  atomic.LoadUint64(&self.stats.udpFailed),
+		},
+		RateLimited:        atomic.LoadUint64(&self.stats.rateLimited),
+		CardinalityLimited: atomic.LoadUint64(&self.stats.cardinalityLimited),
+		BytesSent:          atomic.LoadUint64(&self.stats.bytesSent),
+		QueueDepth:         int(atomic.LoadInt64(&self.pendingPoints)),
+		FlushLatency:       time.Duration(atomic.LoadInt64(&self.stats.flushLatency)),
+	}
+}
+
+// Start a goroutine that reports the client stats as errplane.client.*
+// metrics every sleep interval until the client is closed. Only the first
+// call starts a reporter.
+// Args:
+//
+//	context: all points will be reported with the given context name
+//	dimensions: all points will be reported with the given dimensions
+//	sleep: the sampling frequency
+func (self *Errplane) ReportClientStats(context string, dimensions Dimensions, sleep time.Duration) {
+	if !atomic.CompareAndSwapInt32(&self.clientStatsRunning, 0, 1) {
+		self.warnf("Client stats are already reported")
+		return
+	}
+
+	go func() {
+		for self.sleep(sleep) {
+			self.reportClientStats(context, dimensions)
+		}
+	}()
+}
+
+func (self *Errplane) reportClientStats(context string, dimensions Dimensions) {
+	internal := *self
+	internal.internal = true
+	stats := self.Stats()
+	now := self.clock.Now()
+	values := map[string]float64{
+		"points.enqueued":            float64(stats.Enqueued),
+		"points.flushed":             float64(stats.Flushed),
+		"points.dropped":             float64(stats.Dropped),
+		"points.rate_limited":        float64(stats.RateLimited),
+		"points.cardinality_limited": float64(stats.CardinalityLimited),
+		"requests.retried":           float64(stats.Retried),
+		"bytes_sent":                 float64(stats.BytesSent),
+		"queue.depth":                float64(stats.QueueDepth),
+		"flush.latency":              milliseconds(stats.FlushLatency),
+		"points.failed.http":         float64(stats.Failed[HTTP.String()]),
+		"points.failed.udp":          float64(stats.Failed[UDP.String()]),
+	}
+	for name, value := range values {
+		internal.Report(fmt.Sprintf("errplane.client.%s", name), value, now, context, dimensions)
+	}
+}
@@ -0,0 +1,126 @@
+package errplane
+
+import (
+	"bytes"
+	"context"
+	. "launchpad.net/gocheck"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+type StatsSuite struct{}
+
+var _ = Suite(&StatsSuite{})
+
+func (s *StatsSuite) TestStats(c *C) {
+	server, _ := newStatusServer(503, 201)
+	defer server.Close()
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpScheme("http"),
+		WithHttpHost(server.Listener.Addr().String()),
+		WithUdpAddr(listener.LocalAddr().String()),
+		WithRetryPolicy(RetryPolicy{MaxRetries: 1}),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	stats := ep.Stats()
+	c.Assert(stats.Enqueued, Equals, uint64(3))
+	c.Assert(stats.Flushed, Equals, uint64(3))
+	c.Assert(stats.Retried, Equals, uint64(1))
+	c.Assert(stats.Dropped, Equals, uint64(0))
+	c.Assert(stats.Failed, DeepEquals, map[string]uint64{"http": 0, "udp": 0})
+	c.Assert(stats.BytesSent > 0, Equals, true)
+	c.Assert(stats.QueueDepth, Equals, 0)
+	c.Assert(stats.FlushLatency > 0, Equals, true)
+}
+
+func (s *StatsSuite) TestFailedPerTransport(c *C) {
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithUdpTransport(&recordingTransport{err: errCollectorDown}),
+		WithErrorHandler(func(error) {}),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Aggregate("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), NotNil)
+	c.Assert(ep.Stats().Failed["udp"], Equals, uint64(2))
+}
+
+func (s *StatsSuite) TestReportClientStats(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport))...)
+	c.Assert(err, IsNil)
+
+	ep.ReportClientStats("", nil, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	ep.Close()
+
+	reports := pointsByName(transport.sent(), "")
+	c.Assert(len(reports["errplane.client.points.enqueued"]) > 0, Equals, true)
+	c.Assert(len(reports["errplane.client.queue.depth"]) > 0, Equals, true)
+}
+
+func (s *StatsSuite) TestAggregatedPointsAreCountedAsSent(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions, WithUdpTransport(transport), WithPreAggregation())...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Aggregate("some_timing", 1, "", nil), IsNil)
+	c.Assert(ep.Histogram("some_histogram", 1, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	stats := ep.Stats()
+	c.Assert(stats.Enqueued, Equals, uint64(1+5+len(DEFAULT_PERCENTILES)))
+	c.Assert(stats.Flushed, Equals, stats.Enqueued)
+}
+
+func (s *StatsSuite) TestReportClientStatsOnce(c *C) {
+	buffer := &bytes.Buffer{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithHttpTransport(&recordingTransport{}),
+		WithLogger(NewStdLogger(log.New(buffer, "", 0))),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	ep.ReportClientStats("", nil, time.Hour)
+	ep.ReportClientStats("", nil, time.Hour)
+	c.Assert(strings.HasPrefix(buffer.String(), "WARN Client stats are already reported"), Equals, true)
+}
+
+func (s *StatsSuite) TestQueueDepthIncludesBufferedPoints(c *C) {
+	transport := &recordingTransport{}
+	ep, err := NewWithOptions(append(requiredOptions,
+		WithUdpTransport(transport),
+		WithFlushInterval(time.Hour),
+	)...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	for i := 0; i < 3; i++ {
+		c.Assert(ep.Sum("some_metric", 1, "", nil), IsNil)
+	}
+	// give the flusher time to take the posts off the queue
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(ep.Stats().QueueDepth, Equals, 3)
+
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	c.Assert(ep.Stats().QueueDepth, Equals, 0)
+}
@@ -0,0 +1,145 @@
+package errplane
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// The backoff used by StreamTransport between reconnection attempts
+var DEFAULT_RECONNECT_POLICY = RetryPolicy{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Jitter:         0.2,
+}
+
+// StreamTransport writes operations as newline delimited json over a
+// persistent stream connection. The connection is opened when the first
+// operation is sent and reopened with exponential backoff after an error,
+// while waiting to reconnect Send fails right away.
+type StreamTransport struct {
+	network   string
+	addr      string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	reconnect RetryPolicy
+	stats     *clientStats
+
+	lock     sync.Mutex
+	conn     net.Conn
+	failures int
+	nextDial time.Time
+}
+
+// Create a transport that sends operations over tcp, or over tls if
+// tlsConfig isn't nil.
+func NewTcpTransport(addr string, tlsConfig *tls.Config) (*StreamTransport, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("Invalid tcp address %s. Error: %s", addr, err)
+	}
+	return newStreamTransport("tcp", addr, tlsConfig), nil
+}
+
+// Create a transport that sends operations over the unix stream socket at
+// path, writes block when the reader falls behind, up to the timeout.
+func NewUnixTransport(path string) *StreamTransport {
+	return newStreamTransport("unix", path, nil)
+}
+
+func newStreamTransport(network, addr string, tlsConfig *tls.Config) *StreamTransport {
+	return &StreamTransport{
+		network:   network,
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		timeout:   DEFAULT_TIMEOUT,
+		reconnect: DEFAULT_RECONNECT_POLICY,
+	}
+}
+
+// The timeout used to connect and to write an operation, DEFAULT_TIMEOUT
+// by default
+func (self *StreamTransport) SetTimeout(timeout time.Duration) {
+	self.timeout = timeout
+}
+
+// The backoff between reconnection attempts, DEFAULT_RECONNECT_POLICY by
+// default. MaxRetries is ignored, the transport never stops reconnecting.
+func (self *StreamTransport) SetReconnectPolicy(policy RetryPolicy) {
+	self.reconnect = policy
+}
+
+// Must be called with the lock held
+func (self *StreamTransport) connect() error {
+	if self.conn != nil {
+		return nil
+	}
+	if wait := self.nextDial.Sub(time.Now()); wait > 0 {
+		return &net.OpError{Op: "dial", Net: self.network, Err: fmt.Errorf("waiting %s to reconnect to %s", wait, self.addr)}
+	}
+
+	dialer := &net.Dialer{Timeout: self.timeout}
+	var conn net.Conn
+	var err error
+	if self.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, self.network, self.addr, self.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(self.network, self.addr)
+	}
+	if err != nil {
+		self.failed()
+		return err
+	}
+	self.failures = 0
+	self.conn = conn
+	return nil
+}
+
+// close the connection and schedule the next reconnection attempt. Must be
+// called with the lock held.
+func (self *StreamTransport) failed() {
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+	}
+	self.nextDial = time.Now().Add(self.reconnect.backoff(self.failures))
+	self.failures++
+}
+
+func (self *StreamTransport) Send(data *WriteOperation) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal %#v. Error: %s", data, err)
+	}
+	buf = append(buf, '\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.connect(); err != nil {
+		return err
+	}
+
+	if self.timeout > 0 {
+		self.conn.SetWriteDeadline(time.Now().Add(self.timeout))
+	}
+	// a single write per operation, there's nothing to gain from buffering
+	if _, err := self.conn.Write(buf); err != nil {
+		self.failed()
+		return err
+	}
+	self.stats.addBytes(len(buf))
+	return nil
+}
+
+func (self *StreamTransport) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
@@ -0,0 +1,137 @@
+package errplane
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"net"
+	"time"
+)
+
+type StreamSuite struct {
+	listener    net.Listener
+	connections chan net.Conn
+}
+
+var _ = Suite(&StreamSuite{})
+
+func (self *StreamSuite) SetUpTest(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	self.listener = listener
+	self.connections = make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			self.connections <- conn
+		}
+	}()
+}
+
+func (self *StreamSuite) TearDownTest(c *C) {
+	self.listener.Close()
+}
+
+func (self *StreamSuite) accept(c *C) net.Conn {
+	select {
+	case conn := <-self.connections:
+		return conn
+	case <-time.After(5 * time.Second):
+		c.Fatal("Timed out waiting for a connection")
+	}
+	return nil
+}
+
+func readOperation(c *C, reader *bufio.Reader) *WriteOperation {
+	line, err := reader.ReadBytes('\n')
+	c.Assert(err, IsNil)
+	operation := &WriteOperation{}
+	c.Assert(json.Unmarshal(line, operation), IsNil)
+	return operation
+}
+
+func (self *StreamSuite) TestWritesNewlineDelimitedJson(c *C) {
+	transport, err := NewTcpTransport(self.listener.Addr().String(), nil)
+	c.Assert(err, IsNil)
+	defer transport.Close()
+
+	for _, metric := range []string{"first", "second"} {
+		c.Assert(transport.Send(&WriteOperation{Operation: "r", Writes: []*JsonPoints{{Name: metric}}}), IsNil)
+	}
+
+	conn := self.accept(c)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	c.Assert(readOperation(c, reader).Writes[0].Name, Equals, "first")
+	c.Assert(readOperation(c, reader).Writes[0].Name, Equals, "second")
+
+	// both operations share the same connection
+	select {
+	case <-self.connections:
+		c.Fatal("Expected a single connection")
+	default:
+	}
+}
+
+func (self *StreamSuite) TestReconnectsAfterTheConnectionIsClosed(c *C) {
+	transport, err := NewTcpTransport(self.listener.Addr().String(), nil)
+	c.Assert(err, IsNil)
+	transport.SetReconnectPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer transport.Close()
+
+	c.Assert(transport.Send(&WriteOperation{Operation: "r"}), IsNil)
+	self.accept(c).Close()
+
+	// writes to the closed connection start failing once the peer reset is
+	// noticed, the transport then dials again
+	deadline := time.Now().Add(5 * time.Second)
+	var conn net.Conn
+	for conn == nil && time.Now().Before(deadline) {
+		transport.Send(&WriteOperation{Operation: "r", Writes: []*JsonPoints{{Name: "after"}}})
+		select {
+		case conn = <-self.connections:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(conn, NotNil)
+	defer conn.Close()
+	c.Assert(readOperation(c, bufio.NewReader(conn)).Writes[0].Name, Equals, "after")
+}
+
+func (self *StreamSuite) TestFailsFastWhileWaitingToReconnect(c *C) {
+	addr := self.listener.Addr().String()
+	self.listener.Close()
+
+	transport, err := NewTcpTransport(addr, nil)
+	c.Assert(err, IsNil)
+	transport.SetReconnectPolicy(RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+
+	c.Assert(transport.Send(&WriteOperation{Operation: "r"}), NotNil)
+	err = transport.Send(&WriteOperation{Operation: "r"})
+	c.Assert(err, ErrorMatches, ".*waiting .* to reconnect.*")
+	c.Assert(isRetryable(err), Equals, true)
+}
+
+func (self *StreamSuite) TestSetTcpAddr(c *C) {
+	ep, err := NewWithOptions(append(requiredOptions, WithTcpAddr(self.listener.Addr().String(), nil))...)
+	c.Assert(err, IsNil)
+
+	c.Assert(ep.Sum("some_metric", 2, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	conn := self.accept(c)
+	defer conn.Close()
+	operation := readOperation(c, bufio.NewReader(conn))
+	c.Assert(operation.Operation, Equals, "c")
+	c.Assert(operation.Writes[0].Name, Equals, "some_metric")
+	ep.Close()
+}
+
+func (self *StreamSuite) TestRejectsInvalidTcpAddr(c *C) {
+	_, err := NewTcpTransport("no-port", nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,73 @@
+package errplane
+
+import (
+	"time"
+)
+
+// The dimension added by StopWithError and Time
+const (
+	TIMER_STATUS_DIMENSION = "status"
+	TIMER_STATUS_SUCCESS   = "success"
+	TIMER_STATUS_FAILURE   = "failure"
+)
+
+// Timer measures the time since it was started, the duration is reported in
+// milliseconds using Aggregate.
+//
+//	timer := ep.StartTimer("db.query", "", nil)
+//	defer timer.Stop()
+type Timer struct {
+	ep         *Errplane
+	metric     string
+	context    string
+	dimensions Dimensions
+	start      time.Time
+}
+
+func (self *Errplane) StartTimer(metric, context string, dimensions Dimensions) *Timer {
+	return &Timer{
+		ep:         self,
+		metric:     metric,
+		context:    context,
+		dimensions: dimensions,
+		start:      self.clock.Now(),
+	}
+}
+
+// Report the time since the timer was started
+func (self *Timer) Stop() error {
+	return self.ep.Aggregate(self.metric, milliseconds(self.ep.clock.Now().Sub(self.start)), self.context, self.dimensions)
+}
+
+// Report the time since the timer was started with the status dimension set
+// to success if err is nil or failure otherwise
+func (self *Timer) StopWithError(err error) error {
+	dimensions := withStatus(self.dimensions, err)
+	return self.ep.Aggregate(self.metric, milliseconds(self.ep.clock.Now().Sub(self.start)), self.context, dimensions)
+}
+
+// Call fn and report how long it took with the status dimension set to
+// success or failure. Returns the error returned by fn.
+func (self *Errplane) Time(metric string, fn func() error) error {
+	timer := self.StartTimer(metric, "", nil)
+	err := fn()
+	timer.StopWithError(err)
+	return err
+}
+
+// Report the time since start
+func (self *Errplane) TimeSince(metric string, start time.Time) error {
+	return self.Aggregate(metric, milliseconds(self.clock.Now().Sub(start)), "", nil)
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+func withStatus(dimensions Dimensions, err error) Dimensions {
+	status := TIMER_STATUS_SUCCESS
+	if err != nil {
+		status = TIMER_STATUS_FAILURE
+	}
+	return mergeDimensions(dimensions, Dimensions{TIMER_STATUS_DIMENSION: status})
+}
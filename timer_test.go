@@ -0,0 +1,68 @@
+package errplane
+
+import (
+	"errors"
+	. "launchpad.net/gocheck"
+	"time"
+)
+
+type TimerSuite struct{}
+
+var _ = Suite(&TimerSuite{})
+
+func newTimerTestClient() (*Errplane, *recordingTransport) {
+	transport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetUdpTransport(transport)
+	return ep, transport
+}
+
+func (s *TimerSuite) TestStartTimer(c *C) {
+	ep, transport := newTimerTestClient()
+	dimensions := Dimensions{"foo": "bar"}
+	timer := ep.StartTimer("some_timer", "some_context", dimensions)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(timer.Stop(), IsNil)
+	ep.Close()
+
+	points := pointsByName(transport.sent(), "t")["some_timer"]
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Value >= 20, Equals, true)
+	c.Assert(points[0].Context, Equals, "some_context")
+	c.Assert(points[0].Dimensions, DeepEquals, map[string]string{"foo": "bar"})
+}
+
+func (s *TimerSuite) TestTime(c *C) {
+	ep, transport := newTimerTestClient()
+	failure := errors.New("failure")
+	c.Assert(ep.Time("some_timer", func() error { return nil }), IsNil)
+	c.Assert(ep.Time("some_timer", func() error { return failure }), Equals, failure)
+	ep.Close()
+
+	statuses := make([]string, 0)
+	for _, point := range pointsByName(transport.sent(), "t")["some_timer"] {
+		statuses = append(statuses, point.Dimensions[TIMER_STATUS_DIMENSION])
+	}
+	c.Assert(statuses, DeepEquals, []string{TIMER_STATUS_SUCCESS, TIMER_STATUS_FAILURE})
+}
+
+func (s *TimerSuite) TestStopWithErrorDoesNotModifyDimensions(c *C) {
+	ep, transport := newTimerTestClient()
+	dimensions := Dimensions{"foo": "bar"}
+	c.Assert(ep.StartTimer("some_timer", "", dimensions).StopWithError(nil), IsNil)
+	ep.Close()
+
+	c.Assert(dimensions, HasLen, 1)
+	points := pointsByName(transport.sent(), "t")["some_timer"]
+	c.Assert(points[0].Dimensions, DeepEquals, map[string]string{"foo": "bar", "status": "success"})
+}
+
+func (s *TimerSuite) TestTimeSince(c *C) {
+	ep, transport := newTimerTestClient()
+	c.Assert(ep.TimeSince("some_timer", time.Now().Add(-time.Second)), IsNil)
+	ep.Close()
+
+	points := pointsByName(transport.sent(), "t")["some_timer"]
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Value >= 1000, Equals, true)
+}
@@ -0,0 +1,103 @@
+package errplane
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TlsOptions describes the tls settings of https requests and stream
+// transports, use Config to turn them into a *tls.Config.
+type TlsOptions struct {
+	// PEM file of the CA certificates to trust instead of the system roots
+	CaFile string
+	// CA certificates to trust, added to the ones of CaFile
+	RootCAs *x509.CertPool
+	// PEM files of the client certificate and key used for mutual tls
+	CertFile string
+	KeyFile  string
+	// Overrides the name the server certificate is verified against
+	ServerName string
+	// The minimum tls version, tls.VersionTLS12 by default
+	MinVersion uint16
+	// Base64 encoded sha256 hashes of the SubjectPublicKeyInfo of trusted
+	// keys, if set the verified chain must contain one of them
+	PinnedKeys []string
+}
+
+// Build the *tls.Config described by the options, files are read right
+// away.
+func (self TlsOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: self.ServerName,
+		MinVersion: self.MinVersion,
+		RootCAs:    self.RootCAs,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	if self.CaFile != "" {
+		pem, err := ioutil.ReadFile(self.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA file %s. Error: %s", self.CaFile, err)
+		}
+		if config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		} else {
+			config.RootCAs = config.RootCAs.Clone()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", self.CaFile)
+		}
+	}
+
+	if self.CertFile != "" || self.KeyFile != "" {
+		if self.CertFile == "" || self.KeyFile == "" {
+			return nil, fmt.Errorf("Client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(self.CertFile, self.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate %s. Error: %s", self.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(self.PinnedKeys) > 0 {
+		pins := make(map[string]bool, len(self.PinnedKeys))
+		for _, pin := range self.PinnedKeys {
+			if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("Invalid pinned key %s, expected a base64 encoded sha256 hash", pin)
+			}
+			pins[pin] = true
+		}
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			return verifyPinnedKeys(pins, chains)
+		}
+	}
+	return config, nil
+}
+
+// The pin of a certificate, the base64 encoded sha256 hash of its
+// SubjectPublicKeyInfo
+func SpkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func verifyPinnedKeys(pins map[string]bool, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if pins[SpkiPin(cert)] {
+				return nil
+			}
+		}
+	}
+	return errPinnedKeyMismatch
+}
+
+var errPinnedKeyMismatch = errors.New("None of the server certificates match a pinned key")
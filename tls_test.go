@@ -0,0 +1,227 @@
+package errplane
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TlsSuite struct {
+	dir        string
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	caPool     *x509.CertPool
+	serverCert tls.Certificate
+}
+
+var _ = Suite(&TlsSuite{})
+
+func (self *TlsSuite) SetUpSuite(c *C) {
+	self.dir = c.MkDir()
+	self.ca, self.caKey = self.issue(c, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	self.caPool = x509.NewCertPool()
+	self.caPool.AddCert(self.ca)
+	writePem(c, filepath.Join(self.dir, "ca.pem"), "CERTIFICATE", self.ca.Raw)
+
+	cert, key := self.issue(c, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "collector.internal"},
+		DNSNames:    []string{"collector.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	self.serverCert = tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+
+	cert, key = self.issue(c, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	writePem(c, filepath.Join(self.dir, "client.pem"), "CERTIFICATE", cert.Raw)
+	writePem(c, filepath.Join(self.dir, "client.key"), "EC PRIVATE KEY", keyDer)
+}
+
+// create a certificate signed by the test CA, or a self signed one if the
+// CA doesn't exist yet
+func (self *TlsSuite) issue(c *C, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if self.ca != nil {
+		parent, signer = self.ca, self.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return cert, key
+}
+
+func writePem(c *C, path, blockType string, der []byte) {
+	c.Assert(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600), IsNil)
+}
+
+func (self *TlsSuite) serverConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{self.serverCert},
+		ClientCAs:    self.caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func (self *TlsSuite) options() TlsOptions {
+	return TlsOptions{
+		CaFile:     filepath.Join(self.dir, "ca.pem"),
+		CertFile:   filepath.Join(self.dir, "client.pem"),
+		KeyFile:    filepath.Join(self.dir, "client.key"),
+		ServerName: "collector.internal",
+	}
+}
+
+func (self *TlsSuite) newHttpsClient(c *C, options TlsOptions) (*Errplane, chan string) {
+	names := make(chan string, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		names <- req.TLS.PeerCertificates[0].Subject.CommonName
+		writer.WriteHeader(201)
+	}))
+	server.TLS = self.serverConfig()
+	server.StartTLS()
+	ep, err := NewWithOptions(append(requiredOptions, WithTlsOptions(options),
+		WithHttpHost(strings.TrimPrefix(server.URL, "https://")))...)
+	c.Assert(err, IsNil)
+	return ep, names
+}
+
+func (self *TlsSuite) TestMutualTlsWithPrivateCa(c *C) {
+	ep, names := self.newHttpsClient(c, self.options())
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	c.Assert(<-names, Equals, "client")
+}
+
+func (self *TlsSuite) TestRejectsUnknownCa(c *C) {
+	options := self.options()
+	options.CaFile = ""
+	ep, _ := self.newHttpsClient(c, options)
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), ErrorMatches, ".*certificate.*")
+}
+
+func (self *TlsSuite) TestPinnedKeysOverStreamTransport(c *C) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", self.serverConfig())
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				lines <- line
+			}(conn)
+		}
+	}()
+
+	send := func(pins ...string) error {
+		options := self.options()
+		options.PinnedKeys = pins
+		config, err := options.Config()
+		c.Assert(err, IsNil)
+		transport, err := NewTcpTransport(listener.Addr().String(), config)
+		c.Assert(err, IsNil)
+		defer transport.Close()
+		return transport.Send(&WriteOperation{Operation: "r"})
+	}
+
+	c.Assert(send(SpkiPin(self.ca)), IsNil)
+	c.Assert(<-lines, Matches, "(?s).*\"o\":\"r\".*")
+
+	c.Assert(send(base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))), ErrorMatches, ".*pinned key.*")
+}
+
+func (self *TlsSuite) TestTlsOptionsApplyToTcpTransports(c *C) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", self.serverConfig())
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				lines <- line
+			}(conn)
+		}
+	}()
+	addr := listener.Addr().String()
+
+	ep, err := NewWithOptions(append(requiredOptions, WithTlsOptions(self.options()), WithTcpAddr(addr, nil))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+	c.Assert(ep.ReportUDP("some_metric", 1, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	c.Assert(<-lines, Matches, "(?s).*some_metric.*")
+
+	// the transport is rebuilt when the options are set afterwards
+	other, err := NewWithOptions(append(requiredOptions, WithTcpAddr(addr, nil))...)
+	c.Assert(err, IsNil)
+	defer other.Close()
+	c.Assert(other.SetTlsOptions(self.options()), IsNil)
+	c.Assert(other.ReportUDP("other_metric", 1, "", nil), IsNil)
+	c.Assert(other.Flush(context.Background()), IsNil)
+	c.Assert(<-lines, Matches, "(?s).*other_metric.*")
+}
+
+func (self *TlsSuite) TestValidatesOptions(c *C) {
+	_, err := TlsOptions{CertFile: filepath.Join(self.dir, "client.pem")}.Config()
+	c.Assert(err, ErrorMatches, ".*set together.*")
+
+	_, err = TlsOptions{CaFile: filepath.Join(self.dir, "missing.pem")}.Config()
+	c.Assert(err, ErrorMatches, "Cannot read CA file.*")
+
+	_, err = TlsOptions{CaFile: filepath.Join(self.dir, "client.key")}.Config()
+	c.Assert(err, ErrorMatches, "No certificates found.*")
+
+	_, err = TlsOptions{PinnedKeys: []string{"not a pin"}}.Config()
+	c.Assert(err, ErrorMatches, "Invalid pinned key.*")
+
+	config, err := TlsOptions{}.Config()
+	c.Assert(err, IsNil)
+	c.Assert(config.MinVersion, Equals, uint16(tls.VersionTLS12))
+}
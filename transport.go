@@ -0,0 +1,303 @@
+package errplane
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport delivers a merged WriteOperation to Errplane. HttpTransport and
+// UdpTransport are the built-in implementations, use SetHttpTransport and
+// SetUdpTransport to replace them.
+type Transport interface {
+	Send(operation *WriteOperation) error
+}
+
+// TransportFunc adapts an ordinary function to the Transport interface.
+type TransportFunc func(operation *WriteOperation) error
+
+func (self TransportFunc) Send(operation *WriteOperation) error {
+	return self(operation)
+}
+
+// TransportMiddleware decorates a transport, e.g. to add logging or tracing.
+type TransportMiddleware func(Transport) Transport
+
+// Wrap the given transport with the middleware, the first middleware will be
+// the outermost one.
+func WrapTransport(transport Transport, middleware ...TransportMiddleware) Transport {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		transport = middleware[i](transport)
+	}
+	return transport
+}
+
+// HttpTransport posts the writes of an operation to the http api, retrying
+// failed requests according to its RetryPolicy.
+type HttpTransport struct {
+	url    string
+	client *http.Client
+	retry  RetryPolicy
+	sleep  func(time.Duration)
+	stats  *clientStats
+	// closed when the client stops waiting for the final flush, pending
+	// retries are abandoned
+	stop <-chan struct{}
+
+	compressor           Compressor
+	compressionThreshold int
+}
+
+// Create a transport that posts to the given url using client, if client is
+// nil http.DefaultClient is used. The transport uses DEFAULT_RETRY_POLICY.
+func NewHttpTransport(url string, client *http.Client) *HttpTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HttpTransport{
+		url:    url,
+		client: client,
+		retry:  DEFAULT_RETRY_POLICY,
+	}
+}
+
+func (self *HttpTransport) SetRetryPolicy(policy RetryPolicy) {
+	self.retry = policy
+}
+
+// Compress request bodies of at least threshold bytes with compressor, a
+// nil compressor disables compression, which is the default.
+func (self *HttpTransport) SetCompression(compressor Compressor, threshold int) error {
+	if err := validateCompression(compressor, threshold); err != nil {
+		return err
+	}
+	self.compressor = compressor
+	self.compressionThreshold = threshold
+	return nil
+}
+
+// Send the writes, a request that fails with a retryable error is retried
+// with exponential backoff. If the server asks for a Retry-After delay
+// longer than the policy's MaxBackoff the error is returned right away, as
+// is the last error once Shutdown gave up waiting for the client.
+func (self *HttpTransport) Send(data *WriteOperation) error {
+	buf, err := json.Marshal(data.Writes)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal %#v. Error: %s", data, err)
+	}
+	encoding := ""
+	if self.compressor != nil && len(buf) >= self.compressionThreshold {
+		if buf, err = self.compressor.Compress(buf); err != nil {
+			return fmt.Errorf("Cannot compress request body. Error: %s", err)
+		}
+		encoding = self.compressor.Encoding()
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = self.post(buf, encoding)
+		if err == nil || !isRetryable(err) || attempt >= self.retry.MaxRetries {
+			return err
+		}
+
+		delay := self.retry.backoff(attempt)
+		if httpErr, ok := err.(*HttpError); ok && httpErr.RetryAfter > 0 {
+			if self.retry.MaxBackoff > 0 && httpErr.RetryAfter > self.retry.MaxBackoff {
+				return err
+			}
+			delay = httpErr.RetryAfter
+		}
+		if !self.wait(delay) {
+			return err
+		}
+		self.stats.addRetry()
+	}
+}
+
+// wait before the next attempt, returns false if the transport was stopped
+// in the meantime
+func (self *HttpTransport) wait(delay time.Duration) bool {
+	if self.sleep != nil {
+		self.sleep(delay)
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-self.stop:
+		return false
+	}
+}
+
+func (self *HttpTransport) post(buf []byte, encoding string) error {
+	req, err := http.NewRequest("POST", self.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		return newHttpError(resp)
+	}
+	self.stats.addBytes(len(buf))
+	return nil
+}
+
+// UdpTransport writes operations as datagrams over udp, or over a unix
+// datagram socket. Operations larger than the maximum datagram size are
+// split in several datagrams. The socket is opened when the first operation
+// is sent, and reopened by the next one after a write error.
+type UdpTransport struct {
+	network         string
+	addr            string
+	lock            sync.Mutex
+	conn            net.Conn
+	stats           *clientStats
+	maxDatagramSize int
+}
+
+// Create a transport that sends operations to a host:port over udp, or to
+// a unix datagram socket given as unixgram:///path/to/socket
+func NewUdpTransport(addr string) (*UdpTransport, error) {
+	network, address, err := parseUdpAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		return nil, fmt.Errorf("Invalid udp address %s. Error: unix stream sockets need NewUnixTransport", addr)
+	}
+	return &UdpTransport{network: network, addr: address, maxDatagramSize: DEFAULT_MAX_DATAGRAM_SIZE}, nil
+}
+
+// Parse an address given to SetUdpAddr, either host:port for udp, or
+// unix:///path and unixgram:///path for unix stream and datagram sockets.
+// Returns the network and the address to dial.
+func parseUdpAddr(addr string) (string, string, error) {
+	for _, network := range []string{"unix", "unixgram"} {
+		if path := strings.TrimPrefix(addr, network+"://"); path != addr {
+			if path == "" {
+				return "", "", fmt.Errorf("Invalid udp address %s. Error: missing socket path", addr)
+			}
+			return network, path, nil
+		}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("Invalid udp address %s. Error: %s", addr, err)
+	}
+	return "udp4", addr, nil
+}
+
+// Set the maximum size of a datagram, DEFAULT_MAX_DATAGRAM_SIZE by default.
+// Zero disables splitting.
+func (self *UdpTransport) SetMaxDatagramSize(size int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.maxDatagramSize = size
+}
+
+func (self *UdpTransport) connect() (net.Conn, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn != nil {
+		return self.conn, nil
+	}
+
+	if self.network != "udp4" {
+		conn, err := net.Dial(self.network, self.addr)
+		if err != nil {
+			return nil, err
+		}
+		self.conn = conn
+		return conn, nil
+	}
+
+	localAddr, err := net.ResolveUDPAddr("udp4", "")
+	if err != nil {
+		return nil, err
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp4", self.addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.DialUDP("udp4", localAddr, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	self.conn = udpConn
+	return udpConn, nil
+}
+
+// Send the operation, returns a *DatagramTooLargeError if some points
+// don't fit in a datagram on their own, or a *PartialSendError if a write
+// fails after some of the datagrams were sent.
+func (self *UdpTransport) Send(data *WriteOperation) error {
+	self.lock.Lock()
+	maxSize := self.maxDatagramSize
+	self.lock.Unlock()
+	datagrams, tooLarge, err := splitOperation(data, maxSize)
+	if err != nil {
+		return err
+	}
+
+	if len(datagrams) > 0 {
+		conn, err := self.connect()
+		if err != nil {
+			return err
+		}
+		for i, datagram := range datagrams {
+			written, err := conn.Write(datagram.buf)
+			self.stats.addBytes(written)
+			if err != nil {
+				self.reset(conn)
+				if i == 0 {
+					return err
+				}
+				remaining := tooLarge
+				for _, unsent := range datagrams[i:] {
+					remaining = append(remaining, unsent.operation)
+				}
+				return &PartialSendError{Remaining: joinOperations(data, remaining), Err: err}
+			}
+		}
+	}
+
+	if points := joinOperations(data, tooLarge).pointCount(); points > 0 {
+		return &DatagramTooLargeError{Points: points, MaxSize: maxSize}
+	}
+	return nil
+}
+
+// close the connection after a write error so that the next Send dials
+// again, unless it was replaced in the meantime
+func (self *UdpTransport) reset(conn net.Conn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn == conn {
+		self.conn.Close()
+		self.conn = nil
+	}
+}
+
+func (self *UdpTransport) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
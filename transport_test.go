@@ -0,0 +1,142 @@
+package errplane
+
+import (
+	"context"
+	"io/ioutil"
+	. "launchpad.net/gocheck"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TransportSuite struct{}
+
+var _ = Suite(&TransportSuite{})
+
+type recordingTransport struct {
+	lock       sync.Mutex
+	operations []*WriteOperation
+	err        error
+}
+
+func (self *recordingTransport) Send(operation *WriteOperation) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.operations = append(self.operations, operation)
+	return self.err
+}
+
+func (self *recordingTransport) sent() []*WriteOperation {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*WriteOperation{}, self.operations...)
+}
+
+func (s *TransportSuite) TestCustomTransports(c *C) {
+	httpTransport := &recordingTransport{}
+	udpTransport := &recordingTransport{}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpTransport(httpTransport)
+	ep.SetUdpTransport(udpTransport)
+
+	c.Assert(ep.Report("some_metric", 1.0, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Sum("some_sum", 1.0, "", nil), IsNil)
+	ep.Close()
+
+	c.Assert(httpTransport.sent(), HasLen, 1)
+	c.Assert(httpTransport.sent()[0].Writes[0].Name, Equals, "some_metric")
+	c.Assert(udpTransport.sent(), HasLen, 1)
+	c.Assert(udpTransport.sent()[0].Operation, Equals, "c")
+	c.Assert(udpTransport.sent()[0].Database, Equals, "app4you2lovestaging")
+}
+
+func (s *TransportSuite) TestWrapTransport(c *C) {
+	calls := make([]string, 0)
+	middleware := func(name string) TransportMiddleware {
+		return func(next Transport) Transport {
+			return TransportFunc(func(operation *WriteOperation) error {
+				calls = append(calls, name)
+				return next.Send(operation)
+			})
+		}
+	}
+	inner := &recordingTransport{}
+	transport := WrapTransport(inner, middleware("outer"), middleware("inner"))
+	c.Assert(transport.Send(&WriteOperation{}), IsNil)
+	c.Assert(calls, DeepEquals, []string{"outer", "inner"})
+	c.Assert(inner.sent(), HasLen, 1)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (self roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return self(req)
+}
+
+func (s *TransportSuite) TestDoesNotOverrideDefaultTransport(c *C) {
+	defaultTransport := http.DefaultTransport
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	c.Assert(ep.SetProxy("http://localhost:3128"), IsNil)
+	c.Assert(ep.SetTimeout(5*time.Second), IsNil)
+	ep.Close()
+	c.Assert(http.DefaultTransport, Equals, defaultTransport)
+}
+
+func (s *TransportSuite) TestSetHttpClient(c *C) {
+	requests := make(chan *http.Request, 1)
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requests <- req
+			return &http.Response{
+				StatusCode: http.StatusCreated,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		}),
+	}
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	ep.SetHttpHost("collector.example.com")
+	ep.SetHttpClient(client)
+
+	c.Assert(ep.Report("some_metric", 1.0, time.Now(), "", nil), IsNil)
+	ep.Close()
+
+	req := <-requests
+	c.Assert(req.Method, Equals, "POST")
+	c.Assert(req.URL.Host, Equals, "collector.example.com")
+	c.Assert(req.Header.Get("Content-Type"), Equals, "application/json")
+}
+
+func (s *TransportSuite) TestReplacedClientsCloseIdleConnections(c *C) {
+	closed := make(chan bool, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(201)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- true
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	ep := newTestClient("app4you2love", "staging", "some_key")
+	defer ep.Close()
+	ep.SetHttpHost(strings.TrimPrefix(server.URL, "http://"))
+	c.Assert(ep.Report("some_metric", 1.0, time.Now(), "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	transporter := ep.httpClient.Transport.(*http.Transport)
+	c.Assert(transporter.IdleConnTimeout > 0, Equals, true)
+	c.Assert(transporter.TLSHandshakeTimeout > 0, Equals, true)
+
+	c.Assert(ep.SetTimeout(time.Second), IsNil)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Fatal("The idle connection of the replaced client wasn't closed")
+	}
+}
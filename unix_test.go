@@ -0,0 +1,102 @@
+package errplane
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	. "launchpad.net/gocheck"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type UnixSuite struct{}
+
+var _ = Suite(&UnixSuite{})
+
+func (s *UnixSuite) TestSendsDatagramsToUnixgramSockets(c *C) {
+	path := filepath.Join(c.MkDir(), "errplane.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	ep, err := NewWithOptions(append(requiredOptions, WithUdpAddr("unixgram://"+path))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+	c.Assert(ep.Sum("some_metric", 2, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	buf := make([]byte, 4096)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := listener.Read(buf)
+	c.Assert(err, IsNil)
+	operation := &WriteOperation{}
+	c.Assert(json.Unmarshal(buf[:n], operation), IsNil)
+	c.Assert(operation.Operation, Equals, "c")
+	c.Assert(operation.Writes[0].Name, Equals, "some_metric")
+}
+
+func (s *UnixSuite) TestRedialsAfterWriteErrors(c *C) {
+	path := filepath.Join(c.MkDir(), "errplane.sock")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	transport, err := NewUdpTransport("unixgram://" + path)
+	c.Assert(err, IsNil)
+	defer transport.Close()
+	c.Assert(transport.Send(largeOperation(1, 1)), IsNil)
+
+	// the agent restarts, the old socket is gone
+	listener.Close()
+	c.Assert(os.Remove(path), IsNil)
+	c.Assert(transport.Send(largeOperation(1, 1)), NotNil)
+	listener, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	c.Assert(transport.Send(largeOperation(1, 1)), IsNil)
+
+	buf := make([]byte, 4096)
+	listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = listener.Read(buf)
+	c.Assert(err, IsNil)
+}
+
+func (s *UnixSuite) TestSendsLinesToUnixStreamSockets(c *C) {
+	path := filepath.Join(c.MkDir(), "errplane.sock")
+	listener, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	ep, err := NewWithOptions(requiredOptions...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+	c.Assert(ep.SetUdpAddr("unix://"+path), IsNil)
+	c.Assert(ep.Sum("some_metric", 2, "", nil), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+
+	conn, err := listener.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	operation := readOperation(c, bufio.NewReader(conn))
+	c.Assert(operation.Writes[0].Name, Equals, "some_metric")
+}
+
+func (s *UnixSuite) TestParsesUdpAddresses(c *C) {
+	for addr, expected := range map[string][2]string{
+		"localhost:8126":          {"udp4", "localhost:8126"},
+		"unix:///run/ep.sock":     {"unix", "/run/ep.sock"},
+		"unixgram:///run/ep.sock": {"unixgram", "/run/ep.sock"},
+	} {
+		network, path, err := parseUdpAddr(addr)
+		c.Assert(err, IsNil)
+		c.Assert([2]string{network, path}, Equals, expected)
+	}
+
+	for _, addr := range []string{"localhost", "unix://", "unixgram://"} {
+		_, _, err := parseUdpAddr(addr)
+		c.Assert(err, NotNil, Commentf("%s", addr))
+	}
+	_, err := NewUdpTransport("unix:///run/ep.sock")
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,165 @@
+package errplane
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+// ValidationMode decides what happens to dimensions and contexts that
+// break the DimensionRules
+type ValidationMode int
+
+const (
+	// Report, Sum, Aggregate, etc. return an error
+	ValidationStrict ValidationMode = iota
+	// Invalid characters are replaced with underscores, long strings are
+	// truncated, reserved and extra dimensions are dropped
+	ValidationSanitize
+)
+
+var (
+	// characters that aren't allowed in dimension keys by default
+	INVALID_KEY_CHARACTERS = regexp.MustCompile("[^a-zA-Z0-9._-]")
+	// characters that aren't allowed in dimension values and contexts by
+	// default
+	INVALID_VALUE_CHARACTERS = regexp.MustCompile("[[:cntrl:]]")
+)
+
+// DimensionRules restricts the dimensions and context of points. Lengths
+// are in bytes of utf-8, zero lengths and counts mean no limit, nil regexps
+// allow every character.
+type DimensionRules struct {
+	// matches the characters that aren't allowed in keys
+	InvalidKeyCharacters *regexp.Regexp
+	// matches the characters that aren't allowed in values and contexts
+	InvalidValueCharacters *regexp.Regexp
+	MaxKeyLength           int
+	MaxValueLength         int
+	MaxContextLength       int
+	MaxDimensions          int
+	// keys that can't be used, e.g. the ones set by a local agent
+	ReservedKeys []string
+	Mode         ValidationMode
+}
+
+var DEFAULT_DIMENSION_RULES = DimensionRules{
+	InvalidKeyCharacters:   INVALID_KEY_CHARACTERS,
+	InvalidValueCharacters: INVALID_VALUE_CHARACTERS,
+	MaxKeyLength:           255,
+	MaxValueLength:         255,
+	MaxContextLength:       1024,
+	MaxDimensions:          32,
+}
+
+func validateDimensionRules(rules DimensionRules) error {
+	if rules.MaxKeyLength < 0 || rules.MaxValueLength < 0 || rules.MaxContextLength < 0 || rules.MaxDimensions < 0 {
+		return fmt.Errorf("Dimension rules cannot have negative values")
+	}
+	if rules.Mode != ValidationStrict && rules.Mode != ValidationSanitize {
+		return fmt.Errorf("Unknown validation mode %d", rules.Mode)
+	}
+	return nil
+}
+
+// Make the name valid for DEFAULT_NAME_POLICY, e.g. to build metric names
+// from user input, see NamePolicy.Sanitize
+func Sanitize(name string) string {
+	return DEFAULT_NAME_POLICY.Sanitize(name)
+}
+
+func sanitize(value string, invalid *regexp.Regexp, maxLength int) string {
+	if invalid != nil {
+		value = invalid.ReplaceAllString(value, "_")
+	}
+	return truncate(value, maxLength)
+}
+
+// truncate to at most maxLength bytes without splitting a character
+func truncate(value string, maxLength int) string {
+	if maxLength == 0 || len(value) <= maxLength {
+		return value
+	}
+	for maxLength > 0 && !utf8.RuneStart(value[maxLength]) {
+		maxLength--
+	}
+	return value[:maxLength]
+}
+
+func checkString(kind, value string, invalid *regexp.Regexp, maxLength int) error {
+	if maxLength > 0 && len(value) > maxLength {
+		return fmt.Errorf("Invalid %s %q, it must be at most %d bytes", kind, value, maxLength)
+	}
+	if invalid != nil && invalid.MatchString(value) {
+		return fmt.Errorf("Invalid %s %q", kind, value)
+	}
+	return nil
+}
+
+func (self *DimensionRules) isReserved(key string) bool {
+	for _, reserved := range self.ReservedKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the context and dimensions to send, in sanitizing mode they are
+// copies, the caller's map is never modified.
+func (self *DimensionRules) apply(context string, dimensions Dimensions) (string, Dimensions, error) {
+	if self.Mode == ValidationSanitize {
+		context, dimensions = self.sanitize(context, dimensions)
+		return context, dimensions, nil
+	}
+
+	if err := checkString("context", context, self.InvalidValueCharacters, self.MaxContextLength); err != nil {
+		return "", nil, err
+	}
+	if self.MaxDimensions > 0 && len(dimensions) > self.MaxDimensions {
+		return "", nil, fmt.Errorf("Points can have at most %d dimensions", self.MaxDimensions)
+	}
+	for key, value := range dimensions {
+		if key == "" {
+			return "", nil, fmt.Errorf("Dimension keys cannot be empty")
+		}
+		if self.isReserved(key) {
+			return "", nil, fmt.Errorf("Dimension key %s is reserved", key)
+		}
+		if err := checkString("dimension key", key, self.InvalidKeyCharacters, self.MaxKeyLength); err != nil {
+			return "", nil, err
+		}
+		if err := checkString("dimension value", value, self.InvalidValueCharacters, self.MaxValueLength); err != nil {
+			return "", nil, err
+		}
+	}
+	return context, dimensions, nil
+}
+
+func (self *DimensionRules) sanitize(context string, dimensions Dimensions) (string, Dimensions) {
+	context = sanitize(context, self.InvalidValueCharacters, self.MaxContextLength)
+	if len(dimensions) == 0 {
+		return context, dimensions
+	}
+
+	// sort the keys so the same dimensions are kept every time
+	keys := make([]string, 0, len(dimensions))
+	for key := range dimensions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sanitized := make(Dimensions, len(dimensions))
+	for _, key := range keys {
+		if self.MaxDimensions > 0 && len(sanitized) >= self.MaxDimensions {
+			break
+		}
+		name := sanitize(key, self.InvalidKeyCharacters, self.MaxKeyLength)
+		if name == "" || self.isReserved(name) {
+			continue
+		}
+		sanitized[name] = sanitize(dimensions[key], self.InvalidValueCharacters, self.MaxValueLength)
+	}
+	return context, sanitized
+}
@@ -0,0 +1,85 @@
+package errplane
+
+import (
+	"context"
+	. "launchpad.net/gocheck"
+	"strings"
+	"time"
+)
+
+type ValidationSuite struct{}
+
+var _ = Suite(&ValidationSuite{})
+
+func (s *ValidationSuite) TestSanitize(c *C) {
+	c.Assert(Sanitize("users/signup rate"), Equals, "users_signup_rate")
+	c.Assert(Sanitize("already.valid_name"), Equals, "already.valid_name")
+	c.Assert(Sanitize(strings.Repeat("a", 300)), HasLen, 255)
+	c.Assert(Sanitize("café-latte!"), Equals, "caf_-latte_")
+	c.Assert(ValidateMetricName(Sanitize("café-latte!")), IsNil)
+}
+
+func (s *ValidationSuite) TestTruncatesOnCharacterBoundaries(c *C) {
+	c.Assert(truncate("abé", 3), Equals, "ab")
+	c.Assert(truncate("abé", 4), Equals, "abé")
+	c.Assert(truncate("abc", 0), Equals, "abc")
+}
+
+func (s *ValidationSuite) TestStrictMode(c *C) {
+	rules := DEFAULT_DIMENSION_RULES
+	rules.MaxDimensions = 2
+	rules.ReservedKeys = []string{"agent"}
+
+	_, _, err := rules.apply("", Dimensions{"host": "web1", "region": "us-east-1"})
+	c.Assert(err, IsNil)
+
+	for _, dimensions := range []Dimensions{
+		{"a": "1", "b": "2", "c": "3"},
+		{"": "empty key"},
+		{"agent": "reserved"},
+		{"bad key": "value"},
+		{"key": "new\nline"},
+		{"key": strings.Repeat("v", 256)},
+	} {
+		_, _, err := rules.apply("", dimensions)
+		c.Assert(err, NotNil, Commentf("%v", dimensions))
+	}
+
+	_, _, err = rules.apply(strings.Repeat("c", 1025), nil)
+	c.Assert(err, ErrorMatches, "Invalid context .* at most 1024 bytes")
+}
+
+func (s *ValidationSuite) TestSanitizingMode(c *C) {
+	rules := DEFAULT_DIMENSION_RULES
+	rules.Mode = ValidationSanitize
+	rules.MaxDimensions = 2
+	rules.MaxValueLength = 4
+	rules.ReservedKeys = []string{"agent"}
+
+	dimensions := Dimensions{"agent": "x", "bad key": "new\nline", "c": "3", "d": "4"}
+	context, sanitized, err := rules.apply("some\tcontext", dimensions)
+	c.Assert(err, IsNil)
+	c.Assert(context, Equals, "some_context")
+	c.Assert(sanitized, DeepEquals, Dimensions{"bad_key": "new_", "c": "3"})
+	c.Assert(dimensions["bad key"], Equals, "new\nline")
+}
+
+func (s *ValidationSuite) TestWithDimensionRules(c *C) {
+	transport := &recordingTransport{}
+	rules := DEFAULT_DIMENSION_RULES
+	rules.Mode = ValidationSanitize
+	ep, err := NewWithOptions(append(requiredOptions, WithHttpTransport(transport), WithDimensionRules(rules))...)
+	c.Assert(err, IsNil)
+	defer ep.Close()
+
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", Dimensions{"user id": "42"}), IsNil)
+	c.Assert(ep.Flush(context.Background()), IsNil)
+	points := pointsByName(transport.sent(), "")["some_metric"]
+	c.Assert(points, HasLen, 1)
+	c.Assert(points[0].Dimensions, DeepEquals, map[string]string{"user_id": "42"})
+
+	c.Assert(ep.SetDimensionRules(DEFAULT_DIMENSION_RULES), IsNil)
+	c.Assert(ep.Report("some_metric", 1, time.Now(), "", Dimensions{"user id": "42"}), ErrorMatches, "Invalid dimension key.*")
+	c.Assert(ep.SetDimensionRules(DimensionRules{MaxDimensions: -1}), NotNil)
+	c.Assert(ep.SetDimensionRules(DimensionRules{Mode: ValidationMode(42)}), ErrorMatches, "Unknown validation mode 42")
+}